@@ -80,6 +80,14 @@ func (m *bitmap) clear(idx int) {
 	m.slice[idx>>3] &= ^(1 << (idx % 8))
 }
 
+func (m *bitmap) isSet(idx int) bool {
+	if idx < 0 || idx >= m.size {
+		log.Fatalf("Bad index %d", idx)
+	}
+
+	return m.slice[idx>>3]&(1<<(idx%8)) != 0
+}
+
 // Finds a random bit that is free. Note that for the last byte we mark all the extra unused bits as 1 already
 // so we need not worry about that part.
 func (m *bitmap) findRandomEmpty() int {
@@ -105,7 +113,10 @@ func (m *bitmap) merge(m1 *bitmap) {
 }
 
 func (m *bitmap) writeTo(writer io.Writer) error {
-	encoder := gob.NewEncoder(writer)
+	return m.encode(gob.NewEncoder(writer))
+}
+
+func (m *bitmap) encode(encoder *gob.Encoder) error {
 	if err := encoder.Encode(m.slice); err != nil {
 		return err
 	}
@@ -115,8 +126,9 @@ func (m *bitmap) writeTo(writer io.Writer) error {
 	return nil
 }
 
+// The number of set bits, not counting the unused bits of the last byte.
 func (m *bitmap) usedSize() int {
-	c := 0
+	c := -(len(m.slice)*8 - m.size)
 	for i := 0; i < len(m.slice); i++ {
 		b := m.slice[i]
 		if b != 0 {
@@ -127,7 +139,10 @@ func (m *bitmap) usedSize() int {
 }
 
 func readFrom(reader io.Reader) (*bitmap, error) {
-	decoder := gob.NewDecoder(reader)
+	return decodeBitmap(gob.NewDecoder(reader))
+}
+
+func decodeBitmap(decoder *gob.Decoder) (*bitmap, error) {
 	var m bitmap
 	if err := decoder.Decode(&m.slice); err != nil {
 		return nil, err
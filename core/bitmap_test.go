@@ -74,3 +74,11 @@ func TestBitMapSerialization(t *testing.T) {
 	assert.Equal(t, byte(2), b1.slice[0])
 	os.Remove("/tmp/bitmap_test_file")
 }
+
+func TestUsedSizeIgnoresUnusedBits(t *testing.T) {
+	b := newBitmap(11)
+	assert.Equal(t, 0, b.usedSize())
+	b.set(10)
+	b.set(3)
+	assert.Equal(t, 2, b.usedSize())
+}
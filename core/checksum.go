@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"hash"
+	"hash/crc32"
+	"time"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Computes the size and checksums of the content written to it.
+type checksums struct {
+	size   int64
+	crc32c hash.Hash32
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksums() *checksums {
+	return &checksums{crc32c: crc32.New(crc32cTable), md5: md5.New(), sha256: sha256.New()}
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	c.crc32c.Write(p)
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	return len(p), nil
+}
+
+func (c *checksums) crc32cHex() string {
+	return hex.EncodeToString(c.crc32c.Sum(nil))
+}
+
+func (c *checksums) md5Hex() string {
+	return hex.EncodeToString(c.md5.Sum(nil))
+}
+
+func (c *checksums) sha256Hex() string {
+	return hex.EncodeToString(c.sha256.Sum(nil))
+}
+
+// Compares the size and checksums with the ones the provider returned for the object, and returns the names of the
+// ones compared. The providers return different checksums, e.g. GCS the MD5 and CRC32C, S3 the MD5 (as the ETag) for
+// single part uploads, and the HTTP servers none.
+func (c *checksums) verify(attrs *storage.ObjectAttrs, bucket string, object string) ([]string, error) {
+	var verified []string
+	for _, v := range []struct {
+		name     string
+		known    bool
+		stored   string
+		computed string
+	}{
+		// The size is not known for streamed HTTP responses.
+		{"size", attrs.Size >= 0, fmt.Sprintf("%d", attrs.Size), fmt.Sprintf("%d", c.size)},
+		{"crc32c", attrs.CRC32C != "", attrs.CRC32C, c.crc32cHex()},
+		{"md5", attrs.MD5 != "", attrs.MD5, c.md5Hex()},
+	} {
+		if !v.known {
+			continue
+		}
+		if v.stored != v.computed {
+			return verified, fmt.Errorf("failed to verify object %s/%s, the %s is %s but %s was transferred", bucket,
+				object, v.name, v.stored, v.computed)
+		}
+		verified = append(verified, v.name)
+	}
+	return verified, nil
+}
+
+// The checksums of one processed object, written to the audit files in the state bucket.
+type auditRecord struct {
+	Source       string
+	Destination  string
+	SourceSize   int64
+	SourceCRC32C string
+	SourceMD5    string
+	SourceSHA256 string
+	// The checksums of the source which were compared with the ones returned by the source provider.
+	SourceVerified      []string
+	DestinationSize     int64
+	DestinationCRC32C   string
+	DestinationMD5      string
+	DestinationSHA256   string
+	DestinationVerified []string
+	Time                time.Time
+}
+
+func newAuditRecord(object string, dstObjectName string, src *checksums, dst *checksums) *auditRecord {
+	return &auditRecord{
+		Source:            object,
+		Destination:       dstObjectName,
+		SourceSize:        src.size,
+		SourceCRC32C:      src.crc32cHex(),
+		SourceMD5:         src.md5Hex(),
+		SourceSHA256:      src.sha256Hex(),
+		DestinationSize:   dst.size,
+		DestinationCRC32C: dst.crc32cHex(),
+		DestinationMD5:    dst.md5Hex(),
+		DestinationSHA256: dst.sha256Hex(),
+		Time:              time.Now().UTC(),
+	}
+}
+
+// The audit file of a worker's run of the batch starting at the given index. The objects of a batch can be processed
+// by several runs when some of them fail.
+func auditFileName(pipeline *PipelineConfig, start int, workerId string) string {
+	return fmt.Sprintf("%s.audit_%010d_%s", pipeline.getHash(), start, sha1Str(workerId))
+}
+
+// Writes the records as JSON lines.
+func writeAudit(ctx context.Context, pipeline *PipelineConfig, name string, records []*auditRecord) error {
+	writer, err := storage.GetObjectWriter(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			writer.Abort(err)
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChecksumsVerify(t *testing.T) {
+	c := newChecksums()
+	c.Write([]byte("hello"))
+	verified, err := c.verify(&storage.ObjectAttrs{Size: 5, MD5: "5d41402abc4b2a76b9719d911017c592", CRC32C: "9a71bb4c"}, "mem://b", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"size", "crc32c", "md5"}, verified)
+	verified, err = c.verify(&storage.ObjectAttrs{Size: -1}, "mem://b", "a")
+	assert.NoError(t, err)
+	assert.Empty(t, verified)
+
+	_, err = c.verify(&storage.ObjectAttrs{Size: 4}, "mem://b", "a")
+	assert.Error(t, err)
+	_, err = c.verify(&storage.ObjectAttrs{Size: 5, MD5: "5d41402abc4b2a76b9719d911017c593"}, "mem://b", "a")
+	assert.Error(t, err)
+}
+
+func TestVerifyWritesAudit(t *testing.T) {
+	config := setUpMemory(t, cBatchSize+1)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Verify = true
+	config.Transforms = []TransformConfig{{Type: "GzipCompress", Args: map[string]interface{}{}}}
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	var records []auditRecord
+	files, err := storage.ListObjects(ctx, config.stateStorageProvider, config.StateBucket, config.getHash()+".audit_", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+	for _, f := range files {
+		r, err := storage.GetObjectReader(ctx, config.stateStorageProvider, config.StateBucket, f)
+		assert.NoError(t, err)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var record auditRecord
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			records = append(records, record)
+		}
+		r.Close()
+	}
+	assert.Equal(t, cBatchSize+1, len(records))
+	assert.Equal(t, int64(5), records[0].SourceSize)
+	assert.Equal(t, "d8e8fca2dc0f896fd7cb4cb0031ba249", records[0].SourceMD5)
+	assert.Equal(t, "f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2", records[0].SourceSHA256)
+	assert.Equal(t, []string{"size", "crc32c", "md5"}, records[0].SourceVerified)
+	assert.Equal(t, []string{"size", "crc32c", "md5"}, records[0].DestinationVerified)
+	assert.NotEqual(t, records[0].SourceMD5, records[0].DestinationMD5)
+}
+
+func TestVerifyFailsOnCorruptSourceRead(t *testing.T) {
+	config := setUpMemory(t, 2)
+	defer tearDownMemory(config)
+	config.Verify = true
+
+	// The read ends early with a clean EOF, which the transforms cannot tell from the end of the object.
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{Truncate: map[string]int{"1": 2}})
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"0"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	w, err := ReadMergedState(context.Background(), config, 2, config.run.manifest.fingerprint())
+	assert.NoError(t, err)
+	assert.True(t, w.m.isSet(0))
+	assert.False(t, w.m.isSet(1))
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strings"
+)
+
+// What to do when more than one source object would be written to the same destination object, e.g. "a" and "a.gz"
+// with StripSuffix: ".gz" or two objects modified on the same day with a DestinationKey of the date.
+const (
+	// The run fails before any object is processed.
+	cCollisionFail = "fail"
+	// Only the first of the source objects (by name) is written, the others are skipped.
+	cCollisionSkip = "skip"
+	// The first of the source objects is written to the destination name, and the others to the name with a hash of
+	// the source name inserted before the extension, e.g. "a-0a1b2c3d".
+	cCollisionHash = "hash"
+	// All of them are written, the last one wins.
+	cCollisionOverwrite = "overwrite"
+)
+
+// Source objects which are written to the same destination object.
+type NameCollision struct {
+	Destination string
+	Sources     []string
+}
+
+func validateNameCollision(policy string, deleteSource bool) error {
+	switch policy {
+	case "", cCollisionFail, cCollisionHash, cCollisionOverwrite:
+		return nil
+	case cCollisionSkip:
+		if deleteSource {
+			return fmt.Errorf("OnNameCollision: \"%s\" cannot be used with DeleteSourceOnSuccess, the skipped "+
+				"source objects would be deleted", cCollisionSkip)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid OnNameCollision %s, expected one of %s, %s, %s or %s", policy, cCollisionFail,
+		cCollisionSkip, cCollisionHash, cCollisionOverwrite)
+}
+
+// Returns the destination name of every source object of the manifest, before OnNameCollision is applied.
+func destinationNames(config *PipelineConfig, m *manifest) (map[string]string, error) {
+	names := make(map[string]string, len(m.objects))
+	for _, o := range m.objects {
+		name, err := destinationName(config, o)
+		if err != nil {
+			return nil, err
+		}
+		names[o.Name] = name
+	}
+	return names, nil
+}
+
+// Returns the destination objects written by more than one source object, ordered by name. The sources of every
+// collision are in the order of the manifest, i.e. by name.
+func findCollisions(m *manifest, names map[string]string) []NameCollision {
+	sources := make(map[string][]string)
+	for _, o := range m.objects {
+		name := names[o.Name]
+		sources[name] = append(sources[name], o.Name)
+	}
+	var collisions []NameCollision
+	for name, s := range sources {
+		if len(s) > 1 {
+			collisions = append(collisions, NameCollision{Destination: name, Sources: s})
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Destination < collisions[j].Destination })
+	return collisions
+}
+
+// Inserts a hash of the source name before the extension of the destination name.
+func hashedObjectName(name string, source string) string {
+	ext := path.Ext(name)
+	// The dot files, e.g. ".env", have no extension.
+	if len(ext) == len(path.Base(name)) {
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%.8s%s", strings.TrimSuffix(name, ext), sha1Str(source), ext)
+}
+
+// Returns the destination name of every source object of the manifest, applying OnNameCollision to the collisions.
+// The name is empty for the objects which are skipped.
+func resolveDestinations(config *PipelineConfig, m *manifest) (map[string]string, error) {
+	names, err := destinationNames(config, m)
+	if err != nil {
+		return nil, err
+	}
+	collisions := findCollisions(m, names)
+	if len(collisions) == 0 {
+		return names, nil
+	}
+	switch config.OnNameCollision {
+	case cCollisionOverwrite:
+		for _, c := range collisions {
+			log.Warnf("%s is written by %d source objects %v, the last one written wins", c.Destination,
+				len(c.Sources), c.Sources)
+		}
+	case cCollisionSkip:
+		for _, c := range collisions {
+			log.Warnf("%s is written by %d source objects, only %s is written", c.Destination, len(c.Sources),
+				c.Sources[0])
+			for _, s := range c.Sources[1:] {
+				names[s] = ""
+			}
+		}
+	case cCollisionHash:
+		taken := make(map[string]bool, len(names))
+		for _, n := range names {
+			taken[n] = true
+		}
+		for _, c := range collisions {
+			for _, s := range c.Sources[1:] {
+				name := hashedObjectName(c.Destination, s)
+				if taken[name] {
+					return nil, fmt.Errorf("the hashed name %s of %s collides with another destination object", name, s)
+				}
+				taken[name] = true
+				names[s] = name
+				log.Infof("%s is written to %s since %s is written by %s", s, name, c.Destination, c.Sources[0])
+			}
+		}
+	default:
+		c := collisions[0]
+		return nil, fmt.Errorf("%d destination objects are written by more than one source object, e.g. %s by %v. "+
+			"Set OnNameCollision to \"%s\", \"%s\" or \"%s\" to process them", len(collisions), c.Destination,
+			c.Sources, cCollisionSkip, cCollisionHash, cCollisionOverwrite)
+	}
+	return names, nil
+}
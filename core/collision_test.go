@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Sets up a source where "a" and "a.gz" are both written to "a".
+func setUpCollision(t *testing.T, policy string) *PipelineConfig {
+	config := setUpMemory(t, 0)
+	ctx := context.Background()
+	for _, name := range []string{"a", "a.gz", "b.gz"} {
+		writer, err := storage.GetObjectWriter(ctx, config.sourceStorageProvider, config.SourceBucket, name)
+		assert.NoError(t, err)
+		writer.Write([]byte(name))
+		assert.NoError(t, writer.Close())
+	}
+	config.StripSuffix = ".gz"
+	config.OnNameCollision = policy
+	assert.NoError(t, config.Init(ctx))
+	return config
+}
+
+func readDestination(t *testing.T, config *PipelineConfig, name string) string {
+	reader, err := storage.GetObjectReader(context.Background(), config.destStorageProvider, config.DestinationBucket, name)
+	assert.NoError(t, err)
+	defer reader.Close()
+	b := make([]byte, 16)
+	n, _ := reader.Read(b)
+	return string(b[:n])
+}
+
+func TestNameCollisionFailsByDefault(t *testing.T) {
+	config := setUpCollision(t, "")
+	defer tearDownMemory(config)
+
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.Error(t, err)
+	assert.Empty(t, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestNameCollisionSkip(t *testing.T) {
+	config := setUpCollision(t, cCollisionSkip)
+	defer tearDownMemory(config)
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, []string{"a", "b"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	assert.Equal(t, "a", readDestination(t, config, "a"))
+	_, skipped, _ := config.run.counts()
+	assert.Equal(t, int64(1), skipped)
+}
+
+func TestNameCollisionHash(t *testing.T) {
+	config := setUpCollision(t, cCollisionHash)
+	defer tearDownMemory(config)
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	hashed := hashedObjectName("a", "a.gz")
+	assert.ElementsMatch(t, []string{"a", hashed, "b"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	assert.Equal(t, "a.gz", readDestination(t, config, hashed))
+}
+
+func TestNameCollisionOverwrite(t *testing.T) {
+	config := setUpCollision(t, cCollisionOverwrite)
+	defer tearDownMemory(config)
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, []string{"a", "b"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestHashedObjectName(t *testing.T) {
+	h := sha1Str("src")[:8]
+	assert.Equal(t, "dir/a-"+h+".txt", hashedObjectName("dir/a.txt", "src"))
+	assert.Equal(t, "a-"+h, hashedObjectName("a", "src"))
+	assert.Equal(t, "dir/.env-"+h, hashedObjectName("dir/.env", "src"))
+}
+
+func TestNameCollisionSkipNeedsSources(t *testing.T) {
+	config := &PipelineConfig{SourceBucket: "mem://src", DestinationBucket: "mem://dst", StateBucket: "mem://state",
+		OnNameCollision: cCollisionSkip, DeleteSourceOnSuccess: true}
+	assert.Error(t, config.Init(context.Background()))
+	config.OnNameCollision = "other"
+	config.DeleteSourceOnSuccess = false
+	assert.Error(t, config.Init(context.Background()))
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Identifies the version of configRecord the hash is computed from, so that it can be extended without colliding with
+// the hashes of the earlier versions.
+const cConfigHashVersion = "kromium-config-v2"
+
+type transformRecord struct {
+	Type string
+	// The hash of the canonical JSON of the Args. The args are not recorded as is since they can hold secrets, e.g.
+	// the encryption keys.
+	ArgsHash string
+}
+
+// The fields of the pipeline config which change the destination objects. The pipeline hash covers all of them, so
+// changing any of them starts the job from scratch instead of skipping the objects processed with the old config.
+// It is also written in the state bucket as <hash>.config so that the state files can be traced to their config.
+type configRecord struct {
+	SourceBucket      string
+	SourcePrefix      string
+	NonRecursive      bool
+	DestinationBucket string
+	NameSuffix        string
+	StripSuffix       string
+	// Omitted when empty, so that the hashes of the configs without them did not change when they were added.
+	OnNameCollision       string `json:",omitempty"`
+	DestinationKey        string `json:",omitempty"`
+	DestinationKeyPattern string `json:",omitempty"`
+	Transforms            []transformRecord
+	Metadata              MetadataConfig
+}
+
+func newConfigRecord(p *PipelineConfig) (*configRecord, error) {
+	r := &configRecord{
+		SourceBucket:          p.SourceBucket,
+		SourcePrefix:          p.SourcePrefix,
+		NonRecursive:          p.NonRecursive,
+		DestinationBucket:     p.DestinationBucket,
+		NameSuffix:            p.NameSuffix,
+		StripSuffix:           p.StripSuffix,
+		OnNameCollision:       p.OnNameCollision,
+		DestinationKey:        p.DestinationKey,
+		DestinationKeyPattern: p.DestinationKeyPattern,
+		Metadata:              p.Metadata,
+	}
+	for i, t := range p.Transforms {
+		// The maps are marshalled with sorted keys, so the same args always have the same JSON.
+		args, err := json.Marshal(t.Args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid args of transform %d (%s), %v", i, t.Type, err)
+		}
+		r.Transforms = append(r.Transforms, transformRecord{Type: t.Type, ArgsHash: sha1Str(string(args))})
+	}
+	return r, nil
+}
+
+func (r *configRecord) hash() string {
+	b, _ := json.Marshal(r)
+	h := newSha1Hasher()
+	h.addStr(cConfigHashVersion + "\x00")
+	h.addStr(string(b))
+	return h.getStrHash()
+}
+
+// The hash of the versions before the hash covered the transform args, kept to detect the state they wrote.
+func (p *PipelineConfig) legacyHash() string {
+	h := newSha1Hasher()
+	h.addStr(p.SourceBucket)
+	h.addStr(p.DestinationBucket)
+	h.addStr(p.NameSuffix)
+	for _, t := range p.Transforms {
+		h.addStr(t.Type)
+	}
+	return h.getStrHash()
+}
+
+func configFileName(pipeline *PipelineConfig) string {
+	return pipeline.getHash() + ".config"
+}
+
+func writeConfigRecord(ctx context.Context, pipeline *PipelineConfig) error {
+	r, err := newConfigRecord(pipeline)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer, err := storage.GetObjectWriter(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, configFileName(pipeline))
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(b); err != nil {
+		writer.Abort(err)
+		return err
+	}
+	return writer.Close()
+}
+
+// Returns true if the config has none of the options the legacy hash did not cover, i.e. the legacy state was
+// written by the same config.
+func (p *PipelineConfig) isLegacyEquivalent() bool {
+	if p.SourcePrefix != "" || p.NonRecursive || p.StripSuffix != "" || p.OnNameCollision != "" || p.DestinationKey != "" ||
+		!reflect.DeepEqual(p.Metadata, MetadataConfig{}) {
+		return false
+	}
+	for _, t := range p.Transforms {
+		if args, _ := json.Marshal(t.Args); string(args) != "null" && string(args) != "{}" {
+			return false
+		}
+	}
+	return true
+}
+
+// The number of keys the baseline listed from an S3 bucket, a single page.
+const cBaselineS3Keys = 1000
+
+// Rebuilds the listing of the source by the versions which wrote the legacy state, the bits of which are positions
+// in it: all the keys of the GCS buckets, the first page of the S3 ones and the folder entries, directories included,
+// of the local ones. Returns false for the providers which did not exist then.
+func baselineListing(ctx context.Context, pipeline *PipelineConfig) ([]string, bool, error) {
+	switch {
+	case strings.HasPrefix(pipeline.SourceBucket, "gs://"):
+		names, err := storage.ListObjects(ctx, pipeline.sourceStorageProvider, pipeline.SourceBucket, "", "")
+		return names, true, err
+	case strings.HasPrefix(pipeline.SourceBucket, "s3://"):
+		names, err := storage.ListObjects(ctx, pipeline.sourceStorageProvider, pipeline.SourceBucket, "", "")
+		if len(names) > cBaselineS3Keys {
+			names = names[:cBaselineS3Keys]
+		}
+		return names, true, err
+	case strings.HasPrefix(pipeline.SourceBucket, "file://"):
+		folder, err := pipeline.sourceStorageProvider.GetBucketName(ctx, pipeline.SourceBucket)
+		if err != nil {
+			return nil, false, err
+		}
+		files, err := ioutil.ReadDir(folder)
+		if err != nil {
+			return nil, false, err
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names, true, nil
+	}
+	return nil, false, nil
+}
+
+// Returns true if the manifest lists the objects in the same order as the versions which wrote the legacy state, so
+// that its bits refer to the same objects.
+func matchesBaselineListing(ctx context.Context, pipeline *PipelineConfig, m *manifest) (bool, error) {
+	names, ok, err := baselineListing(ctx, pipeline)
+	if err != nil || !ok || len(names) != len(m.objects) {
+		return false, err
+	}
+	for i, o := range m.objects {
+		if names[i] != o.Name {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Rewrites the state written by this config before the hash covered the transform args under the current hash and
+// the fingerprint of the manifest, so that it is resumed. It is discarded unless the config has no transform args
+// and naming options, which could have changed since it was written, and the manifest matches the listing it was
+// written for. The legacy files are kept, `kromium state gc` deletes them.
+func migrateLegacyState(ctx context.Context, pipeline *PipelineConfig, m *manifest) error {
+	legacy := pipeline.legacyHash()
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, legacy+"_", "/")
+	if err != nil {
+		log.Debugf("Error in listing the legacy state %s %v", legacy, err)
+		return nil
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if !pipeline.isLegacyEquivalent() {
+		log.Warnf("Discarding the progress of %d state files of this pipeline written by an earlier version (%s), "+
+			"since it did not record the transform args and naming options. Run `kromium state` to inspect them",
+			len(files), legacy)
+		return nil
+	}
+	matches, err := matchesBaselineListing(ctx, pipeline, m)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		log.Warnf("Discarding the progress of %d state files of this pipeline written by an earlier version (%s), "+
+			"since the source is not listed the same way any more. Run `kromium state` to inspect them",
+			len(files), legacy)
+		return nil
+	}
+	for _, f := range files {
+		reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, f)
+		if err != nil {
+			return err
+		}
+		s, err := decodeStateFile(reader)
+		reader.Close()
+		if err != nil {
+			log.Errorf("Ignoring the corrupt legacy state file %s, %v", f, err)
+			continue
+		}
+		// Version 0 has no times, the rewritten file is dated by the migration.
+		s.hash, s.fingerprint, s.started, s.written = pipeline.getHash(), m.fingerprint(), time.Now(), time.Now()
+		b, err := s.encode()
+		if err != nil {
+			return err
+		}
+		name := pipeline.getHash() + strings.TrimPrefix(f, legacy)
+		writer, err := storage.GetObjectWriter(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(b); err != nil {
+			writer.Abort(err)
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		log.Infof("Migrated the legacy state file %s to %s", f, name)
+	}
+	return nil
+}
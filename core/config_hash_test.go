@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConfigHashCoversOutputOptions(t *testing.T) {
+	base := getIdentityPipelineConfigForUris("mem://src", "mem://dst", "mem://state")
+	for name, change := range map[string]func(p *PipelineConfig){
+		"args": func(p *PipelineConfig) {
+			p.Transforms[0].Args = map[string]interface{}{"level": 9}
+		},
+		"strip suffix":  func(p *PipelineConfig) { p.StripSuffix = ".gz" },
+		"source prefix": func(p *PipelineConfig) { p.SourcePrefix = "logs/" },
+		"non recursive": func(p *PipelineConfig) { p.NonRecursive = true },
+		"metadata":      func(p *PipelineConfig) { p.Metadata.ContentType = "text/plain" },
+	} {
+		config := *base
+		config.Transforms = append([]TransformConfig{}, base.Transforms...)
+		change(&config)
+		assert.NoError(t, config.Init(context.Background()))
+		assert.NotEqual(t, base.getHash(), config.getHash(), name)
+	}
+}
+
+func TestConfigHashIgnoresRunOptions(t *testing.T) {
+	base := getIdentityPipelineConfigForUris("mem://src", "mem://dst", "mem://state")
+	config := *base
+	config.Retry.MaxAttempts = 5
+	config.BatchSize = 4
+	config.Verify = true
+	assert.NoError(t, config.Init(context.Background()))
+	assert.Equal(t, base.getHash(), config.getHash())
+}
+
+func TestConfigHashOfEqualArgs(t *testing.T) {
+	config1 := getIdentityPipelineConfigForUris("mem://src", "mem://dst", "mem://state")
+	config1.Transforms[0].Args = map[string]interface{}{"a": "1", "b": []interface{}{1, 2}}
+	assert.NoError(t, config1.Init(context.Background()))
+	config2 := *config1
+	config2.Transforms = []TransformConfig{{Type: "Identity", Args: map[string]interface{}{"b": []interface{}{1, 2}, "a": "1"}}}
+	assert.NoError(t, config2.Init(context.Background()))
+	assert.Equal(t, config1.getHash(), config2.getHash())
+}
+
+func TestStateReportGroupsByConfig(t *testing.T) {
+	config := setUpMemory(t, 2)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	writer, err := storage.GetObjectWriter(ctx, config.stateStorageProvider, config.StateBucket, config.legacyHash()+"_legacy")
+	assert.NoError(t, err)
+	assert.NoError(t, newBitmap(1).writeTo(writer))
+	assert.NoError(t, writer.Close())
+
+	report, err := InspectState(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(report.Groups))
+	current := report.Groups[0]
+	assert.Equal(t, cRelationCurrent, current.Relation)
+	assert.Equal(t, config.SourceBucket, current.Config.SourceBucket)
+	assert.Equal(t, 1, current.Files["manifest"])
+	assert.Equal(t, 1, len(current.StateFiles))
+	assert.Equal(t, cStateVersion, current.StateFiles[0].Version)
+	assert.Equal(t, 2, current.StateFiles[0].Processed)
+	assert.Equal(t, cRelationLegacy, report.Groups[1].Relation)
+	assert.Equal(t, 0, report.Groups[1].StateFiles[0].Version)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), config.getHash()+" (current)")
+}
+
+// Writes a worker state file of the format before the hash covered the transform args, a gob bitmap of the batches.
+func writeLegacyState(t *testing.T, config *PipelineConfig, batches int, done ...int) {
+	b := newBitmap(batches)
+	for _, i := range done {
+		b.set(i)
+	}
+	writer, err := storage.GetObjectWriter(context.Background(), config.stateStorageProvider, config.StateBucket,
+		config.legacyHash()+"_"+sha1Str("worker"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.writeTo(writer))
+	assert.NoError(t, writer.Close())
+}
+
+// Returns the number of objects marked as processed in the state of the manifest.
+func processedAfterMigration(t *testing.T, config *PipelineConfig) int {
+	ctx := context.Background()
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	w, err := ReadMergedState(ctx, config, len(m.objects), m.fingerprint())
+	assert.NoError(t, err)
+	return w.m.usedSize()
+}
+
+func TestLegacyStateIsMigrated(t *testing.T) {
+	setUp(2 * cBatchSize)
+	defer tearDown()
+	config := getPipelineConfig()
+	writeLegacyState(t, config, 2, 0)
+
+	assert.Equal(t, cBatchSize, processedAfterMigration(t, config))
+	s := readStateFileInfo(context.Background(), config, config.getHash()+"_"+sha1Str("worker"))
+	assert.NoError(t, s.Err)
+	assert.NotEmpty(t, s.Fingerprint)
+}
+
+func TestLegacyStateWithArgsIsDiscarded(t *testing.T) {
+	setUp(2 * cBatchSize)
+	defer tearDown()
+	config := getPipelineConfig()
+	config.Transforms[0].Args = map[string]interface{}{"level": 9}
+	assert.NoError(t, config.Init(context.Background()))
+	writeLegacyState(t, config, 2, 0)
+
+	assert.Equal(t, 0, processedAfterMigration(t, config))
+}
+
+// The baseline listed the directories of a local source as objects, so its bits do not refer to the same objects.
+func TestLegacyStateOfDifferentListingIsDiscarded(t *testing.T) {
+	setUp(2*cBatchSize - 1)
+	defer tearDown()
+	createNestedFile(t, "sub/nested")
+	config := getPipelineConfig()
+	writeLegacyState(t, config, 2, 0)
+
+	assert.Equal(t, 0, processedAfterMigration(t, config))
+}
+
+func TestLegacyStateOfNewProvidersIsDiscarded(t *testing.T) {
+	config := setUpMemory(t, 2*cBatchSize)
+	defer tearDownMemory(config)
+	writeLegacyState(t, config, 2, 0)
+
+	assert.Equal(t, 0, processedAfterMigration(t, config))
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How the objects which fail are set aside, so that they do not halt the run.
+type DeadLetterConfig struct {
+	// Records the objects which fail permanently or run out of retries in the dead-letter log in the state bucket and
+	// carries on with the others. They can be processed again with RetryFailed (the -retry-failed flag).
+	Enabled bool
+	// If set, the failed source objects are also copied as is to this bucket, under the same names.
+	QuarantineBucket string
+}
+
+// An object which failed, as recorded in the dead-letter log.
+type deadLetterRecord struct {
+	Object string
+	// The index of the transform which failed, -1 if the failure was in reading or writing the objects.
+	Transform     int
+	TransformType string
+	Error         string
+	Attempts      int
+	Quarantined   bool
+	Time          time.Time
+}
+
+// The failure of a transform stage.
+type transformError struct {
+	index     int
+	transform string
+	err       error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("transform [%d] %s failed, %v", e.index, e.transform, e.err)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+func newDeadLetterRecord(object string, attempts int, err error) *deadLetterRecord {
+	r := &deadLetterRecord{Object: object, Transform: -1, Error: err.Error(), Attempts: attempts, Time: time.Now().UTC()}
+	var tErr *transformError
+	if errors.As(err, &tErr) {
+		r.Transform = tErr.index
+		r.TransformType = tErr.transform
+	}
+	return r
+}
+
+// The dead-letter file of a worker's run of the batch starting at the given index.
+func deadLetterFileName(pipeline *PipelineConfig, start int, workerId string) string {
+	return fmt.Sprintf("%s.deadletter_%010d_%s", pipeline.getHash(), start, sha1Str(workerId))
+}
+
+func writeDeadLetters(ctx context.Context, pipeline *PipelineConfig, name string, records []*deadLetterRecord) error {
+	writer, err := storage.GetObjectWriter(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			writer.Abort(err)
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func readDeadLetters(ctx context.Context, pipeline *PipelineConfig, name string) ([]*deadLetterRecord, error) {
+	reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var records []*deadLetterRecord
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	for {
+		var r deadLetterRecord
+		if err := decoder.Decode(&r); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read the dead-letter log %s, %v", name, err)
+		}
+		records = append(records, &r)
+	}
+}
+
+func listDeadLetterFiles(ctx context.Context, pipeline *PipelineConfig) ([]string, error) {
+	return storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, pipeline.getHash()+".deadletter_", "/")
+}
+
+// Returns the names of all the dead-lettered objects.
+func readDeadLetteredObjects(ctx context.Context, pipeline *PipelineConfig) (map[string]bool, error) {
+	files, err := listDeadLetterFiles(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]bool)
+	for _, f := range files {
+		records, err := readDeadLetters(ctx, pipeline, f)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			objects[r.Object] = true
+		}
+	}
+	return objects, nil
+}
+
+// Copies the source object as is to the quarantine bucket.
+func quarantineObject(ctx context.Context, pipeline *PipelineConfig, object string) error {
+	reader, err := storage.GetObjectReader(ctx, pipeline.sourceStorageProvider, pipeline.SourceBucket, object)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := storage.GetObjectWriter(ctx, pipeline.quarantineStorageProvider, pipeline.DeadLetter.QuarantineBucket, object)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Abort(err)
+		return err
+	}
+	return writer.Close()
+}
+
+// Records the failed object, and quarantines it if configured.
+func deadLetterObject(ctx context.Context, pipeline *PipelineConfig, object string, attempts int, err error) *deadLetterRecord {
+	record := newDeadLetterRecord(object, attempts, err)
+	if pipeline.DeadLetter.QuarantineBucket != "" {
+		if qErr := quarantineObject(ctx, pipeline, object); qErr != nil {
+			log.Warnf("Failed to quarantine %s to %s, %v", object, pipeline.DeadLetter.QuarantineBucket, qErr)
+		} else {
+			record.Quarantined = true
+		}
+	}
+	return record
+}
+
+// Processes the dead-lettered objects of the pipeline again. The objects which succeed are removed from the dead-letter
+// log, and the ones which fail again stay with the new error.
+func RetryFailed(ctx context.Context, config *PipelineConfig, parallelism int) error {
+	if parallelism <= 0 {
+		return fmt.Errorf("illegal parallelism: %d", parallelism)
+	}
+	files, err := listDeadLetterFiles(ctx, config)
+	if err != nil {
+		return err
+	}
+	destinations, err := config.getDestinations(ctx)
+	if err != nil {
+		return err
+	}
+	var succeeded, failed int64
+	for _, f := range files {
+		records, err := readDeadLetters(ctx, config, f)
+		if err != nil {
+			return err
+		}
+		remaining := make([]*deadLetterRecord, len(records))
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, parallelism)
+		for i, r := range records {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, r *deadLetterRecord) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				dst, ok := destinations[r.Object]
+				var err error
+				if !ok {
+					// The object is no longer in the manifest, e.g. it was re-planned.
+					dst, err = destinationNameOf(ctx, config, r.Object)
+				}
+				var result objectResult
+				if err == nil {
+					result, err = processObjectWithRetries(ctx, config, 0, r.Object, dst)
+				}
+				if err != nil {
+					log.Warnf("Retry of %s failed, %v", r.Object, err)
+					remaining[i] = deadLetterObject(ctx, config, r.Object, r.Attempts+result.attempts, err)
+					atomic.AddInt64(&failed, 1)
+					return
+				}
+				atomic.AddInt64(&succeeded, 1)
+			}(i, r)
+		}
+		wg.Wait()
+
+		var stillFailed []*deadLetterRecord
+		var processed []string
+		for i, r := range remaining {
+			if r != nil {
+				stillFailed = append(stillFailed, r)
+			} else {
+				processed = append(processed, records[i].Object)
+			}
+		}
+		if len(stillFailed) > 0 {
+			err = writeDeadLetters(ctx, config, f, stillFailed)
+		} else {
+			err = storage.DeleteObject(ctx, config.stateStorageProvider, config.StateBucket, f)
+		}
+		if err != nil {
+			return err
+		}
+		// Only once they are out of the dead-letter log, a crash before this leaves them to the clean up at the end of
+		// the next run.
+		if config.DeleteSourceOnSuccess {
+			for _, o := range processed {
+				if err := storage.DeleteObject(ctx, config.sourceStorageProvider, config.SourceBucket, o); err != nil &&
+					!errors.Is(err, storage.ErrObjectNotExist) {
+					log.Warnf("Failed to delete the processed source object %s, %v", o, err)
+				}
+			}
+		}
+	}
+	fmt.Printf("Retried %d failed files, %d succeeded and %d failed again\n", succeeded+failed, succeeded, failed)
+	return nil
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func writeSourceObject(t *testing.T, config *PipelineConfig, object string, data []byte) {
+	w, err := storage.GetObjectWriter(context.Background(), config.sourceStorageProvider, config.SourceBucket, object)
+	assert.NoError(t, err)
+	w.Write(data)
+	assert.NoError(t, w.Close())
+}
+
+func gzipBytes(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(data))
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// Sets up a source with a valid gzip 0 and a corrupt gzip 1, to be decompressed.
+func setUpDeadLetter(t *testing.T) *PipelineConfig {
+	config := setUpMemory(t, 0)
+	writeSourceObject(t, config, "0", gzipBytes(t, "a"))
+	writeSourceObject(t, config, "1", []byte("not a gzip"))
+	config.Transforms = []TransformConfig{{Type: "Identity"}, {Type: "GzipDecompress"}}
+	config.Retry = RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms"}
+	config.DeadLetter = DeadLetterConfig{Enabled: true}
+	return config
+}
+
+func TestFailedObjectIsDeadLettered(t *testing.T) {
+	config := setUpDeadLetter(t)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.DeadLetter.QuarantineBucket = config.DestinationBucket + "_quarantine"
+	defer storage.ResetMemoryBucket(config.DeadLetter.QuarantineBucket)
+	assert.NoError(t, config.Init(ctx))
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	assert.Equal(t, []string{"0"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	assert.Equal(t, []string{"1"}, listBucket(t, config.quarantineStorageProvider, config.DeadLetter.QuarantineBucket))
+	files, err := listDeadLetterFiles(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	records, err := readDeadLetters(ctx, config, files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "1", records[0].Object)
+	assert.Equal(t, 1, records[0].Transform)
+	assert.Equal(t, "GzipDecompress", records[0].TransformType)
+	assert.Contains(t, records[0].Error, "invalid header")
+	// Corrupt content is not retried.
+	assert.Equal(t, 1, records[0].Attempts)
+	assert.True(t, records[0].Quarantined)
+	_, _, failed := config.run.counts()
+	assert.Equal(t, int64(1), failed)
+}
+
+func TestCanceledObjectIsNotDeadLettered(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	config.Retry = RetryConfig{MaxAttempts: 5, InitialBackoff: "1h", MaxBackoff: "1h"}
+	config.DeadLetter = DeadLetterConfig{Enabled: true}
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{FailReadN: 1})
+
+	// Canceled while the failed object waits for its retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.True(t, errors.Is(err, context.Canceled))
+	files, err := listDeadLetterFiles(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	m, err := config.getManifest(context.Background())
+	assert.NoError(t, err)
+	w, err := ReadMergedState(context.Background(), config, len(m.objects), m.fingerprint())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, w.m.usedSize())
+}
+
+func TestRetryFailed(t *testing.T) {
+	config := setUpDeadLetter(t)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+
+	// Still failing.
+	assert.NoError(t, RetryFailed(ctx, config, 2))
+	files, err := listDeadLetterFiles(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	records, err := readDeadLetters(ctx, config, files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, records[0].Attempts)
+
+	writeSourceObject(t, config, "1", gzipBytes(t, "b"))
+	assert.NoError(t, RetryFailed(ctx, config, 2))
+	assert.Equal(t, []string{"0", "1"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	files, err = listDeadLetterFiles(ctx, config)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDeadLetteredSourceIsNotDeleted(t *testing.T) {
+	config := setUpDeadLetter(t)
+	defer tearDownMemory(config)
+	config.DeleteSourceOnSuccess = true
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, []string{"1"}, listBucket(t, config.sourceStorageProvider, config.SourceBucket))
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/sharvanath/kromium/transforms"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// The values the DestinationKey template is executed with, for every source object.
+type destinationKeyData struct {
+	// The source key, e.g. "logs/2021/app.log".
+	Key string
+	// The key relative to SourcePrefix.
+	Rel string
+	// The folder of the key ("logs/2021"), empty at the top level.
+	Dir string
+	// The last element of the key ("app.log"), its extension (".log") and the element without it ("app").
+	Base string
+	Ext  string
+	Name string
+	// The elements of the key split by "/".
+	Parts []string
+	// The captures of DestinationKeyPattern, Match 0 being the whole match, and the named ones by name.
+	Match  []string
+	Groups map[string]string
+	// As listed from the source.
+	Size    int64
+	ModTime time.Time
+	// Emitted by the transforms: Base with the extensions of the transformed content (e.g. "app.log.gz" with
+	// GzipCompress), and the content type and encoding they set.
+	TransformedBase string
+	ContentType     string
+	ContentEncoding string
+}
+
+var destinationKeyFuncs = template.FuncMap{
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+}
+
+// The compiled DestinationKey and DestinationKeyPattern.
+type destinationKey struct {
+	template *template.Template
+	pattern  *regexp.Regexp
+	stages   []transforms.Transform
+}
+
+func newDestinationKey(p *PipelineConfig) (*destinationKey, error) {
+	if p.DestinationKey == "" {
+		if p.DestinationKeyPattern != "" {
+			return nil, errors.New("DestinationKeyPattern is only used with DestinationKey")
+		}
+		return nil, nil
+	}
+	if p.NameSuffix != "" || p.StripSuffix != "" {
+		return nil, errors.New("NameSuffix and StripSuffix cannot be used with DestinationKey, use the template instead")
+	}
+	t, err := template.New("DestinationKey").Funcs(destinationKeyFuncs).Option("missingkey=error").Parse(p.DestinationKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DestinationKey, %v", err)
+	}
+	k := &destinationKey{template: t}
+	if p.DestinationKeyPattern != "" {
+		if k.pattern, err = regexp.Compile(p.DestinationKeyPattern); err != nil {
+			return nil, fmt.Errorf("invalid DestinationKeyPattern, %v", err)
+		}
+	}
+	for _, tc := range p.Transforms {
+		if t := transforms.GetTransform(tc.Type, tc.Args); t != nil {
+			k.stages = append(k.stages, t)
+		}
+	}
+	return k, nil
+}
+
+func (k *destinationKey) execute(config *PipelineConfig, o storage.ObjectInfo) (string, error) {
+	dir := path.Dir(o.Name)
+	if dir == "." {
+		dir = ""
+	}
+	base := path.Base(o.Name)
+	d := destinationKeyData{
+		Key:     o.Name,
+		Rel:     strings.TrimPrefix(o.Name, config.SourcePrefix),
+		Dir:     dir,
+		Base:    base,
+		Ext:     path.Ext(base),
+		Name:    strings.TrimSuffix(base, path.Ext(base)),
+		Parts:   strings.Split(o.Name, "/"),
+		Size:    o.Size,
+		ModTime: o.ModTime,
+	}
+	if k.pattern != nil {
+		if d.Match = k.pattern.FindStringSubmatch(o.Name); d.Match == nil {
+			return "", fmt.Errorf("%s does not match DestinationKeyPattern %s", o.Name, k.pattern)
+		}
+		d.Groups = make(map[string]string)
+		for i, name := range k.pattern.SubexpNames() {
+			if name != "" {
+				d.Groups[name] = d.Match[i]
+			}
+		}
+	}
+	d.TransformedBase = base
+	attrs := &storage.ObjectAttrs{}
+	for _, t := range k.stages {
+		if n, ok := t.(transforms.NameTransform); ok {
+			d.TransformedBase = n.TransformName(d.TransformedBase)
+		}
+		if a, ok := t.(transforms.AttrsTransform); ok {
+			a.TransformAttrs(attrs)
+		}
+	}
+	d.ContentType, d.ContentEncoding = attrs.ContentType, attrs.ContentEncoding
+
+	var buf bytes.Buffer
+	if err := k.template.Execute(&buf, d); err != nil {
+		return "", fmt.Errorf("failed to execute DestinationKey for %s, %v", o.Name, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("DestinationKey is empty for %s", o.Name)
+	}
+	return buf.String(), nil
+}
+
+// Returns the literal text the template starts with, which every destination name it executes to starts with.
+func (k *destinationKey) literalPrefix() string {
+	nodes := k.template.Tree.Root.Nodes
+	if len(nodes) == 0 || nodes[0].Type() != parse.NodeText {
+		return ""
+	}
+	return string(nodes[0].(*parse.TextNode).Text)
+}
+
+// Returns the name of the destination object written from the source object, given by DestinationKey if set and by
+// NameSuffix and StripSuffix otherwise.
+func destinationName(config *PipelineConfig, o storage.ObjectInfo) (string, error) {
+	if config.destinationKey == nil {
+		return getObjectName(o.Name, config.NameSuffix, config.StripSuffix), nil
+	}
+	return config.destinationKey.execute(config, o)
+}
+
+// Returns the destination name of an object which is not in the manifest, e.g. a dead-lettered object of an earlier
+// manifest.
+func destinationNameOf(ctx context.Context, config *PipelineConfig, object string) (string, error) {
+	o := storage.ObjectInfo{Name: object}
+	if config.destinationKey != nil {
+		attrs, err := storage.StatObject(ctx, config.sourceStorageProvider, config.SourceBucket, object)
+		if err != nil {
+			return "", err
+		}
+		o.Size, o.ModTime = attrs.Size, attrs.ModTime
+	}
+	return destinationName(config, o)
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func destinationKeyConfig(t *testing.T, key string, pattern string, transforms ...TransformConfig) *PipelineConfig {
+	config := &PipelineConfig{SourceBucket: "mem://src", DestinationBucket: "mem://dst", StateBucket: "mem://state",
+		SourcePrefix: "logs/", DestinationKey: key, DestinationKeyPattern: pattern, Transforms: transforms}
+	assert.NoError(t, config.Init(context.Background()))
+	return config
+}
+
+func TestDestinationKey(t *testing.T) {
+	o := storage.ObjectInfo{Name: "logs/app/2021-03-04.log", Size: 42, ModTime: time.Date(2021, 3, 5, 0, 0, 0, 0, time.UTC)}
+	for _, c := range []struct {
+		key      string
+		pattern  string
+		expected string
+	}{
+		{"{{.Key}}", "", "logs/app/2021-03-04.log"},
+		{"{{.ModTime.Format \"2006/01/02\"}}/{{.Base}}", "", "2021/03/05/2021-03-04.log"},
+		{"archive/{{.Rel}}", "", "archive/app/2021-03-04.log"},
+		{"{{index .Parts 1}}/{{.Name}}-{{.Size}}{{.Ext}}", "", "app/2021-03-04-42.log"},
+		{"{{.Dir | trimPrefix \"logs/\" | upper}}/{{.Base}}", "", "APP/2021-03-04.log"},
+		{"year={{.Groups.year}}/{{index .Match 2}}/{{.Base}}", `(?P<year>\d{4})-(\d{2})`, "year=2021/03/2021-03-04.log"},
+		{"{{.TransformedBase}} {{.ContentEncoding}}", "", "2021-03-04.log.gz gzip"},
+	} {
+		config := destinationKeyConfig(t, c.key, c.pattern, TransformConfig{Type: "GzipCompress",
+			Args: map[string]interface{}{}})
+		name, err := destinationName(config, o)
+		assert.NoError(t, err, c.key)
+		assert.Equal(t, c.expected, name, c.key)
+	}
+}
+
+func TestDestinationKeyErrors(t *testing.T) {
+	o := storage.ObjectInfo{Name: "logs/a"}
+	config := destinationKeyConfig(t, "{{.Groups.year}}", `(?P<year>\d{4})`)
+	_, err := destinationName(config, o)
+	assert.Error(t, err)
+	config = destinationKeyConfig(t, "{{.Dir | trimPrefix \"logs\"}}", "")
+	_, err = destinationName(config, o)
+	assert.Error(t, err)
+
+	for _, c := range []*PipelineConfig{
+		{DestinationKey: "{{.Key"},
+		{DestinationKey: "{{.Key}}", DestinationKeyPattern: "("},
+		{DestinationKey: "{{.Key}}", NameSuffix: ".gz"},
+		{DestinationKeyPattern: "a"},
+	} {
+		c.SourceBucket, c.DestinationBucket, c.StateBucket = "mem://src", "mem://dst", "mem://state"
+		assert.Error(t, c.Init(context.Background()))
+	}
+}
+
+func TestRunWithDestinationKey(t *testing.T) {
+	config := setUpMemory(t, 2)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.DestinationKey = "copies/{{.Key}}.txt"
+	assert.NoError(t, config.Init(ctx))
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	assert.Equal(t, []string{"copies/0.txt", "copies/1.txt"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cDefaultLeaseDuration = 10 * time.Minute
+	cMaxLeasePollInterval = 5 * time.Second
+)
+
+// How the workers claim the batches, so that concurrent workers (including the ones in other processes) do not
+// process the same batch.
+type LeaseConfig struct {
+	// Claims every batch with a lease file in the state bucket before processing it. The provider of the state bucket
+	// must support conditional creates, which all but the http(s) ones do.
+	Enabled bool
+	// How long a claim is valid without renewal, e.g. "5m", 10m by default. The worker renews it while it processes
+	// the batch, so this is how long the batch of a crashed worker waits until another worker reclaims it.
+	Duration string
+}
+
+func (l *LeaseConfig) validate() error {
+	d, err := parseDuration(l.Duration, cDefaultLeaseDuration)
+	if err != nil {
+		return fmt.Errorf("invalid lease Duration %s, %v", l.Duration, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid lease Duration %s, it must be positive", l.Duration)
+	}
+	return nil
+}
+
+// The config is validated in Init.
+func (l *LeaseConfig) duration() time.Duration {
+	d, _ := parseDuration(l.Duration, cDefaultLeaseDuration)
+	return d
+}
+
+// The wait before looking for a batch again when all the remaining ones are claimed by other workers.
+func (l *LeaseConfig) pollInterval() time.Duration {
+	if d := l.duration() / 10; d < cMaxLeasePollInterval {
+		return d
+	}
+	return cMaxLeasePollInterval
+}
+
+// The content of a lease file.
+type leaseRecord struct {
+	WorkerId string
+	Expiry   time.Time
+}
+
+// A claim on a batch held by this worker. A batch can be claimed many times, e.g. when a worker crashes, and every
+// claim creates the lease file of the next generation. Only one worker can create a given file, so only one of the
+// workers which find the latest lease expired gets the batch.
+type lease struct {
+	pipeline   *PipelineConfig
+	start      int
+	generation int
+	workerId   string
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func leasePrefix(pipeline *PipelineConfig, start int) string {
+	return fmt.Sprintf("%s.lease_%010d_", pipeline.getHash(), start)
+}
+
+func leaseFileName(pipeline *PipelineConfig, start int, generation int) string {
+	return fmt.Sprintf("%s%010d", leasePrefix(pipeline, start), generation)
+}
+
+// Returns the lease files of the batch, ordered by generation.
+func listLeaseFiles(ctx context.Context, pipeline *PipelineConfig, start int) ([]string, error) {
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, leasePrefix(pipeline, start), "/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func leaseGeneration(pipeline *PipelineConfig, start int, file string) (int, error) {
+	return strconv.Atoi(strings.TrimPrefix(file, leasePrefix(pipeline, start)))
+}
+
+// Returns true if the lease is not expired. A lease file which cannot be decoded (e.g. still being written on a file
+// system) is valid for the lease duration since it was modified.
+func isLeaseHeld(ctx context.Context, pipeline *PipelineConfig, file string) (bool, error) {
+	reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, file)
+	if err != nil {
+		// Released since it was listed.
+		if _, serr := storage.StatObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, file); errors.Is(serr, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	b, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return false, err
+	}
+	var record leaseRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		attrs, err := storage.StatObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, file)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		record.Expiry = attrs.ModTime.Add(pipeline.Lease.duration())
+	}
+	return time.Now().Before(record.Expiry), nil
+}
+
+func (l *lease) content() []byte {
+	b, _ := json.Marshal(leaseRecord{WorkerId: l.workerId, Expiry: time.Now().Add(l.pipeline.Lease.duration())})
+	return b
+}
+
+// Claims the batch starting at the given index. Returns nil if another worker holds the batch.
+func claimBatch(ctx context.Context, pipeline *PipelineConfig, start int, workerId string) (*lease, error) {
+	files, err := listLeaseFiles(ctx, pipeline, start)
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{pipeline: pipeline, start: start, workerId: workerId}
+	if len(files) > 0 {
+		latest := files[len(files)-1]
+		held, err := isLeaseHeld(ctx, pipeline, latest)
+		if err != nil || held {
+			return nil, err
+		}
+		generation, err := leaseGeneration(pipeline, start, latest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease file %s, %v", latest, err)
+		}
+		l.generation = generation + 1
+	}
+	err = storage.CreateObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket,
+		leaseFileName(pipeline, start, l.generation), l.content())
+	if errors.Is(err, storage.ErrObjectExists) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.renew(ctx)
+	return l, nil
+}
+
+// Extends the expiry of the lease periodically until it is released.
+func (l *lease) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.pipeline.Lease.duration() / 3)
+	defer ticker.Stop()
+	name := leaseFileName(l.pipeline, l.start, l.generation)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		writer, err := storage.GetObjectWriter(ctx, l.pipeline.stateStorageProvider, l.pipeline.StateBucket, name)
+		if err == nil {
+			if _, err = writer.Write(l.content()); err != nil {
+				writer.Abort(err)
+			} else {
+				err = writer.Close()
+			}
+		}
+		if err != nil {
+			log.Warnf("Failed to renew the lease %s, %v", name, err)
+		}
+	}
+}
+
+// Stops the renewal and deletes the lease files of the batch up to this generation. The later ones belong to the
+// workers which reclaimed the batch after this lease expired.
+func (l *lease) release(ctx context.Context) {
+	close(l.stop)
+	<-l.done
+	files, err := listLeaseFiles(ctx, l.pipeline, l.start)
+	if err != nil {
+		log.Debugf("Error in listing the leases of batch %d %v", l.start, err)
+		return
+	}
+	for _, f := range files {
+		if generation, err := leaseGeneration(l.pipeline, l.start, f); err != nil || generation > l.generation {
+			continue
+		}
+		if err := storage.DeleteObject(ctx, l.pipeline.stateStorageProvider, l.pipeline.StateBucket, f); err != nil {
+			log.Debugf("Error in deleting %s %v", f, err)
+		}
+	}
+}
+
+// Reads the state and picks a batch with objects which are not processed yet. With leases the batch is claimed first,
+// waiting while all the remaining batches are claimed by other workers. The start is -1 once all the objects are
+// processed.
+func claimProcessingRange(ctx context.Context, config *PipelineConfig, m *manifest, batches []int, workerId string) (*WorkerState, int, int, *lease, error) {
+	for {
+		w, err := ReadMergedState(ctx, config, len(m.objects), m.fingerprint())
+		if err != nil {
+			return nil, -1, -1, nil, err
+		}
+		if !config.Lease.Enabled {
+			start, end := w.findProcessingRange(batches)
+			return w, start, end, nil, nil
+		}
+		pending := w.pendingBatches(batches)
+		if len(pending) == 0 {
+			return w, -1, -1, nil, nil
+		}
+
+		var claimed *lease
+		var end int
+		for _, i := range rand.Perm(len(pending)) {
+			var start int
+			start, end = batchRange(batches, pending[i], len(m.objects))
+			if claimed, err = claimBatch(ctx, config, start, workerId); err != nil {
+				return nil, -1, -1, nil, err
+			}
+			if claimed != nil {
+				break
+			}
+		}
+		if claimed == nil {
+			select {
+			case <-time.After(config.Lease.pollInterval()):
+			case <-ctx.Done():
+				return nil, -1, -1, nil, ctx.Err()
+			}
+			continue
+		}
+
+		// The batch could have been completed by the previous holder since the state was read.
+		if w, err = ReadMergedState(ctx, config, len(m.objects), m.fingerprint()); err != nil {
+			claimed.release(ctx)
+			return nil, -1, -1, nil, err
+		}
+		if w.hasPending(claimed.start, end) {
+			return w, claimed.start, end, claimed, nil
+		}
+		claimed.release(ctx)
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Writes the lease of a worker which is not running, e.g. one which crashed.
+func writeLease(t *testing.T, config *PipelineConfig, start int, generation int, expiry time.Time) {
+	b, err := json.Marshal(leaseRecord{WorkerId: "other", Expiry: expiry})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateObject(context.Background(), config.stateStorageProvider, config.StateBucket,
+		leaseFileName(config, start, generation), b))
+}
+
+func TestClaimBatch(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true, Duration: "1m"}
+
+	l, err := claimBatch(ctx, config, 0, "a")
+	assert.NoError(t, err)
+	assert.NotNil(t, l)
+	other, err := claimBatch(ctx, config, 0, "b")
+	assert.NoError(t, err)
+	assert.Nil(t, other)
+	other, err = claimBatch(ctx, config, cBatchSize, "b")
+	assert.NoError(t, err)
+	assert.NotNil(t, other)
+	other.release(ctx)
+
+	l.release(ctx)
+	assert.Empty(t, listBucket(t, config.stateStorageProvider, config.StateBucket))
+	l, err = claimBatch(ctx, config, 0, "b")
+	assert.NoError(t, err)
+	assert.NotNil(t, l)
+	l.release(ctx)
+}
+
+func TestExpiredLeaseIsReclaimed(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true}
+
+	writeLease(t, config, 0, 0, time.Now().Add(-time.Second))
+	l, err := claimBatch(ctx, config, 0, "a")
+	assert.NoError(t, err)
+	assert.NotNil(t, l)
+	assert.Equal(t, 1, l.generation)
+	l.release(ctx)
+	assert.Empty(t, listBucket(t, config.stateStorageProvider, config.StateBucket))
+}
+
+func TestUndecodableLeaseIsHeld(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true}
+
+	assert.NoError(t, storage.CreateObject(ctx, config.stateStorageProvider, config.StateBucket, leaseFileName(config, 0, 0), nil))
+	l, err := claimBatch(ctx, config, 0, "a")
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+}
+
+func TestLeaseIsRenewed(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true, Duration: "30ms"}
+
+	l, err := claimBatch(ctx, config, 0, "a")
+	assert.NoError(t, err)
+	defer l.release(ctx)
+	time.Sleep(100 * time.Millisecond)
+	held, err := isLeaseHeld(ctx, config, leaseFileName(config, 0, 0))
+	assert.NoError(t, err)
+	assert.True(t, held)
+}
+
+func TestRunPipelineWaitsForClaimedBatch(t *testing.T) {
+	config := setUpMemory(t, 2*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true, Duration: "500ms"}
+
+	// The first batch is claimed by a worker which stopped, the second one is free.
+	writeLease(t, config, 0, 0, time.Now().Add(100*time.Millisecond))
+	c, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cBatchSize, c)
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, listBucket(t, config.destStorageProvider, config.DestinationBucket), m.objects[0].Name)
+
+	c, err = RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cBatchSize, c)
+	assert.Equal(t, 2*cBatchSize, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+}
+
+func TestParallelWorkersWithLeases(t *testing.T) {
+	config := setUpMemory(t, 8*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Lease = LeaseConfig{Enabled: true, Duration: "1s"}
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 4, false))
+	copied, _, _ := config.run.counts()
+	assert.Equal(t, int64(8*cBatchSize), copied)
+	leases, err := storage.ListObjects(ctx, config.stateStorageProvider, config.StateBucket, config.getHash()+".lease_", "")
+	assert.NoError(t, err)
+	assert.Empty(t, leases)
+}
+
+func TestLeaseNeedsConditionalCreates(t *testing.T) {
+	config := &PipelineConfig{SourceBucket: "mem://src", DestinationBucket: "mem://dst", StateBucket: "https://example.com/state",
+		Lease: LeaseConfig{Enabled: true}}
+	assert.Error(t, config.Init(context.Background()))
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// The listing snapshot of the source bucket. It is taken once at the start of a job and persisted in the state
+// bucket, so that all the workers (including the ones in other processes) index into the same list of objects.
+// This keeps the object indexes in the worker state stable, and the source is not re-listed for every batch.
+type manifest struct {
+	// Sorted by name.
+	objects []storage.ObjectInfo
+}
+
+const (
+	cSourceChangeFail   = "fail"
+	cSourceChangeReplan = "replan"
+)
+
+func manifestFileName(pipeline *PipelineConfig) string {
+	return pipeline.getHash() + ".manifest"
+}
+
+func (m *manifest) names() []string {
+	names := make([]string, len(m.objects))
+	for i, o := range m.objects {
+		names[i] = o.Name
+	}
+	return names
+}
+
+// Splits the objects into batches of at most batchSize objects (cBatchSize if 0) and, if batchBytes is set, at most
+// batchBytes bytes, and returns the start index of every batch.
+func (m *manifest) batches(batchSize int, batchBytes int64) []int {
+	if batchSize <= 0 {
+		batchSize = cBatchSize
+	}
+	var starts []int
+	count := 0
+	var size int64
+	for i, o := range m.objects {
+		if i == 0 || count == batchSize || (batchBytes > 0 && size+o.Size > batchBytes) {
+			starts = append(starts, i)
+			count = 0
+			size = 0
+		}
+		count++
+		size += o.Size
+	}
+	return starts
+}
+
+// Identifies the set of source objects, the count and the hash of the sorted names.
+func (m *manifest) fingerprint() string {
+	h := newSha1Hasher()
+	h.addStr(strconv.Itoa(len(m.objects)))
+	for _, o := range m.objects {
+		// The separator avoids collisions like ["ab", "c"] and ["a", "bc"].
+		h.addStr("\x00" + o.Name)
+	}
+	return h.getStrHash()
+}
+
+func (m *manifest) writeTo(writer io.Writer) error {
+	encoder := gob.NewEncoder(writer)
+	if err := encoder.Encode(len(m.objects)); err != nil {
+		return err
+	}
+	for _, o := range m.objects {
+		if err := encoder.Encode(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readManifestFrom(reader io.Reader) (*manifest, error) {
+	decoder := gob.NewDecoder(reader)
+	var count int
+	if err := decoder.Decode(&count); err != nil {
+		return nil, err
+	}
+	m := &manifest{objects: make([]storage.ObjectInfo, count)}
+	for i := range m.objects {
+		if err := decoder.Decode(&m.objects[i]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func listSource(ctx context.Context, pipeline *PipelineConfig) (*manifest, error) {
+	it, err := storage.GetObjectIterator(ctx, pipeline.sourceStorageProvider, pipeline.SourceBucket,
+		pipeline.SourcePrefix, pipeline.sourceDelimiter())
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	for {
+		o, err := it.Next()
+		if err == storage.Done {
+			// The listing order is not guaranteed by all the providers, sort it so that the object indexes are stable.
+			sort.Slice(m.objects, func(i, j int) bool { return m.objects[i].Name < m.objects[j].Name })
+			return &m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.objects = append(m.objects, *o)
+	}
+}
+
+// Returns nil if the manifest has not been written yet.
+func readManifest(ctx context.Context, pipeline *PipelineConfig) (*manifest, error) {
+	name := manifestFileName(pipeline)
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name, "/")
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, f := range files {
+		found = found || f == name
+	}
+	if !found {
+		return nil, nil
+	}
+
+	reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readManifestFrom(reader)
+}
+
+func writeManifest(ctx context.Context, pipeline *PipelineConfig, m *manifest) error {
+	writer, err := storage.GetObjectWriter(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, manifestFileName(pipeline))
+	if err != nil {
+		return err
+	}
+	if err := m.writeTo(writer); err != nil {
+		writer.Abort(err)
+		return err
+	}
+	return writer.Close()
+}
+
+// Lists the source and compares it with the persisted manifest. If this is the first run of the job the listing is
+// persisted as the manifest. If the set of source objects has changed since the job started, the run either fails or
+// re-plans depending on OnSourceChange.
+func loadOrCreateManifest(ctx context.Context, pipeline *PipelineConfig) (*manifest, error) {
+	current, err := listSource(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	persisted, err := readManifest(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	if persisted == nil {
+		// Nothing to process, a later run should list the source again.
+		if len(current.objects) == 0 {
+			return current, nil
+		}
+		if err := migrateLegacyState(ctx, pipeline, current); err != nil {
+			return nil, fmt.Errorf("failed to migrate the legacy state, %v", err)
+		}
+		if err := writeConfigRecord(ctx, pipeline); err != nil {
+			return nil, err
+		}
+		log.Debugf("Writing the manifest %s with %d objects", manifestFileName(pipeline), len(current.objects))
+		return current, writeManifest(ctx, pipeline, current)
+	}
+
+	if persisted.fingerprint() == current.fingerprint() {
+		log.Debugf("Using the existing manifest %s with %d objects", manifestFileName(pipeline), len(persisted.objects))
+		return persisted, nil
+	}
+
+	if pipeline.DeleteSourceOnSuccess {
+		ok, err := onlyProcessedSourcesRemoved(ctx, pipeline, persisted, current)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			log.Debugf("Using the existing manifest %s, %d processed objects were moved", manifestFileName(pipeline),
+				len(persisted.objects)-len(current.objects))
+			return persisted, nil
+		}
+	}
+
+	if pipeline.OnSourceChange != cSourceChangeReplan {
+		return nil, fmt.Errorf("the source objects changed since the job started (%d objects then, %d now), refusing "+
+			"to resume. Set OnSourceChange: \"%s\" to re-plan the job keeping the progress of unchanged objects",
+			len(persisted.objects), len(current.objects), cSourceChangeReplan)
+	}
+	log.Infof("The source objects changed since the job started (%d objects then, %d now), re-planning",
+		len(persisted.objects), len(current.objects))
+	return current, replan(ctx, pipeline, persisted, current)
+}
+
+// Carries the progress over from the old manifest to the new one. The objects of the new manifest are marked as
+// processed if they were processed in the old one. The new state is written before the new manifest, and the old state
+// files are deleted only after that, so that a crash at any point is safe.
+func replan(ctx context.Context, pipeline *PipelineConfig, old *manifest, current *manifest) error {
+	oldState, err := ReadMergedState(ctx, pipeline, len(old.objects), old.fingerprint())
+	if err != nil {
+		return err
+	}
+	processed := make(map[string]bool)
+	for i, o := range old.objects {
+		processed[o.Name] = oldState.m.isSet(i)
+	}
+
+	newState := createState(pipeline, len(current.objects), current.fingerprint())
+	newState.workerId = uuid.New().String()
+	for i, o := range current.objects {
+		if processed[o.Name] {
+			newState.setProcessed(i)
+		}
+	}
+	if err := WriteState(ctx, pipeline.StateBucket, newState); err != nil {
+		return err
+	}
+	if err := writeManifest(ctx, pipeline, current); err != nil {
+		return err
+	}
+	for _, f := range oldState.mergedFiles {
+		if err := storage.DeleteObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, f); err != nil {
+			log.Debugf("Error in deleting %s %v", f, err)
+		}
+	}
+	return nil
+}
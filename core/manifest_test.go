@@ -0,0 +1,152 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManifestSerialization(t *testing.T) {
+	m := manifest{objects: []storage.ObjectInfo{
+		{Name: "a", Size: 1, ModTime: time.Unix(10, 0)},
+		{Name: "b/c", Size: 2},
+	}}
+	var b bytes.Buffer
+	assert.NoError(t, m.writeTo(&b))
+	m1, err := readManifestFrom(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b/c"}, m1.names())
+	assert.Equal(t, int64(2), m1.objects[1].Size)
+	assert.True(t, m1.objects[0].ModTime.Equal(time.Unix(10, 0)))
+}
+
+func TestManifestIsWrittenOnce(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	ctx := context.Background()
+	config := getPipelineConfig()
+
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(m.objects))
+	_, err = os.Stat(state_dir + "/" + manifestFileName(config))
+	assert.NoError(t, err)
+
+	m1, err := getPipelineConfig().getManifest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, m.fingerprint(), m1.fingerprint())
+}
+
+func TestManifestIsSorted(t *testing.T) {
+	setUp(12)
+	defer tearDown()
+	m, err := getPipelineConfig().getManifest(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "10", "11", "2", "3", "4", "5", "6", "7", "8", "9"}, m.names())
+}
+
+func TestManifestFingerprint(t *testing.T) {
+	m1 := manifest{objects: []storage.ObjectInfo{{Name: "ab"}, {Name: "c"}}}
+	m2 := manifest{objects: []storage.ObjectInfo{{Name: "a"}, {Name: "bc"}}}
+	m3 := manifest{objects: []storage.ObjectInfo{{Name: "ab", Size: 10}, {Name: "c"}}}
+	assert.NotEqual(t, m1.fingerprint(), m2.fingerprint())
+	assert.Equal(t, m1.fingerprint(), m3.fingerprint())
+}
+
+func TestChangedSourceRefusesToResume(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	ctx := context.Background()
+	_, err := getPipelineConfig().getManifest(ctx)
+	assert.NoError(t, err)
+
+	f, err := os.Create(fmt.Sprintf("%s/%d", src_dir, 3))
+	assert.NoError(t, err)
+	f.Close()
+	_, err = getPipelineConfig().getManifest(ctx)
+	assert.Error(t, err)
+	assert.Error(t, RunPipelineLoop(ctx, getPipelineConfig(), 1, false))
+}
+
+func TestChangedSourceReplanKeepsProgress(t *testing.T) {
+	setUp(2 * cBatchSize)
+	defer tearDown()
+	ctx := context.Background()
+	assert.NoError(t, RunPipelineLoop(ctx, getPipelineConfig(), 1, false))
+
+	// "a" sorts after the numeric names. Removing "0" shifts the indexes of the others, which stay processed.
+	f, err := os.Create(src_dir + "/a")
+	assert.NoError(t, err)
+	f.Close()
+	assert.NoError(t, os.Remove(src_dir+"/0"))
+
+	config := getPipelineConfig()
+	config.OnSourceChange = cSourceChangeReplan
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*cBatchSize, len(m.objects))
+
+	w, err := ReadMergedState(ctx, config, len(m.objects), m.fingerprint())
+	assert.NoError(t, err)
+	// Only "a" is not processed.
+	assert.Equal(t, 2*cBatchSize, w.m.size)
+	assert.Equal(t, 2*cBatchSize-1, w.m.usedSize())
+	assert.False(t, w.m.isSet(2*cBatchSize-1))
+	assert.Equal(t, 1, len(w.mergedFiles))
+
+	// The next run resumes from the new manifest.
+	m1, err := getPipelineConfig().getManifest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, m.fingerprint(), m1.fingerprint())
+}
+
+func TestLegacyStateWithoutFingerprintIsIgnored(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	ctx := context.Background()
+	config := getPipelineConfig()
+
+	b := newBitmap(1)
+	b.set(0)
+	writer, err := storage.GetObjectWriter(ctx, config.stateStorageProvider, config.StateBucket, config.getHash()+"_legacy")
+	assert.NoError(t, err)
+	assert.NoError(t, b.writeTo(writer))
+	assert.NoError(t, writer.Close())
+
+	// Its bits could refer to the objects of another listing.
+	w, err := ReadMergedState(ctx, config, 3, "fingerprint")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, w.m.usedSize())
+}
+
+func TestEmptyManifestIsNotWritten(t *testing.T) {
+	setUp(0)
+	defer tearDown()
+	ctx := context.Background()
+	config := getPipelineConfig()
+
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(m.objects))
+	files, err := storage.ListObjects(ctx, config.stateStorageProvider, config.StateBucket, "", "/")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestManifestBatches(t *testing.T) {
+	m := &manifest{}
+	for _, size := range []int64{10, 10, 50, 10, 100, 10} {
+		m.objects = append(m.objects, storage.ObjectInfo{Size: size})
+	}
+	assert.Equal(t, []int{0}, m.batches(0, 0))
+	assert.Equal(t, []int{0, 4}, m.batches(4, 0))
+	// The object larger than the limit gets a batch of its own.
+	assert.Equal(t, []int{0, 3, 4, 5}, m.batches(0, 70))
+	assert.Equal(t, []int{0, 2, 4}, m.batches(2, 0))
+	assert.Empty(t, (&manifest{}).batches(0, 0))
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"github.com/sharvanath/kromium/storage"
+	"github.com/sharvanath/kromium/transforms"
+)
+
+const (
+	cMetadataPreserve = "preserve"
+	cMetadataDrop     = "drop"
+	cMetadataRewrite  = "rewrite"
+)
+
+// How the attributes (content type, encoding, user metadata, timestamps) of the destination objects are set.
+type MetadataConfig struct {
+	// "drop" (default) sets only the attributes derived by the transforms, "preserve" copies the ones of the source
+	// object, and "rewrite" copies them and then applies the fields below.
+	Mode               string
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	// Merged into the user metadata, an empty value removes the key.
+	Custom map[string]string
+}
+
+// Returns true if the attributes of the source object are copied, which needs a stat of every source object.
+func (m *MetadataConfig) copiesSource() bool {
+	return m.Mode == cMetadataPreserve || m.Mode == cMetadataRewrite
+}
+
+// Overrides the attributes with the non-empty fields of the config.
+func (m *MetadataConfig) rewrite(attrs *storage.ObjectAttrs) {
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&attrs.ContentType, m.ContentType},
+		{&attrs.ContentEncoding, m.ContentEncoding},
+		{&attrs.CacheControl, m.CacheControl},
+		{&attrs.ContentDisposition, m.ContentDisposition},
+		{&attrs.ContentLanguage, m.ContentLanguage},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	for k, v := range m.Custom {
+		if v == "" {
+			delete(attrs.Metadata, k)
+			continue
+		}
+		if attrs.Metadata == nil {
+			attrs.Metadata = map[string]string{}
+		}
+		attrs.Metadata[k] = v
+	}
+}
+
+// Returns the attributes to write the destination object with, given the attributes of the source object (nil if
+// they are dropped).
+func getDestinationAttrs(config *PipelineConfig, src *storage.ObjectAttrs, stages []transforms.Transform) *storage.ObjectAttrs {
+	attrs := &storage.ObjectAttrs{}
+	if src != nil && config.Metadata.copiesSource() {
+		attrs = src.Copy()
+		attrs.Size = 0
+		attrs.MD5 = ""
+		attrs.ETag = ""
+	}
+	for _, t := range stages {
+		if a, ok := t.(transforms.AttrsTransform); ok {
+			a.TransformAttrs(attrs)
+		}
+	}
+	if config.Metadata.Mode == cMetadataRewrite {
+		config.Metadata.rewrite(attrs)
+	}
+	return attrs
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"context"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/sharvanath/kromium/transforms"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func writeSourceWithAttrs(t *testing.T, config *PipelineConfig, attrs *storage.ObjectAttrs) {
+	w, err := storage.GetObjectWriterWithAttrs(context.Background(), config.sourceStorageProvider, config.SourceBucket, "0", attrs)
+	assert.NoError(t, err)
+	w.Write([]byte("test\n"))
+	assert.NoError(t, w.Close())
+}
+
+func getDestinationObjectAttrs(t *testing.T, config *PipelineConfig) *storage.ObjectAttrs {
+	attrs, err := storage.StatObject(context.Background(), config.destStorageProvider, config.DestinationBucket, "0")
+	assert.NoError(t, err)
+	return attrs
+}
+
+func TestMetadataPreserve(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeSourceWithAttrs(t, config, &storage.ObjectAttrs{ContentType: "text/plain", CacheControl: "no-cache",
+		Metadata: map[string]string{"owner": "kromium"}, ModTime: mtime})
+	config.Transforms = []TransformConfig{{Type: "GzipCompress", Args: map[string]interface{}{}}}
+	config.Metadata.Mode = cMetadataPreserve
+
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.NoError(t, err)
+	attrs := getDestinationObjectAttrs(t, config)
+	assert.Equal(t, "text/plain", attrs.ContentType)
+	assert.Equal(t, "gzip", attrs.ContentEncoding)
+	assert.Equal(t, "no-cache", attrs.CacheControl)
+	assert.Equal(t, map[string]string{"owner": "kromium"}, attrs.Metadata)
+	assert.Equal(t, mtime, attrs.ModTime)
+}
+
+func TestMetadataIsDroppedByDefault(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeSourceWithAttrs(t, config, &storage.ObjectAttrs{ContentType: "text/plain", Metadata: map[string]string{"owner": "kromium"}})
+	config.Transforms = []TransformConfig{{Type: "GzipCompress", Args: map[string]interface{}{}}}
+
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.NoError(t, err)
+	attrs := getDestinationObjectAttrs(t, config)
+	assert.Equal(t, "", attrs.ContentType)
+	assert.Equal(t, "gzip", attrs.ContentEncoding)
+	assert.Empty(t, attrs.Metadata)
+}
+
+func TestMetadataRewrite(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeSourceWithAttrs(t, config, &storage.ObjectAttrs{ContentType: "text/plain", ContentEncoding: "gzip",
+		Metadata: map[string]string{"owner": "kromium", "tmp": "1"}})
+	config.Metadata = MetadataConfig{Mode: cMetadataRewrite, CacheControl: "max-age=60",
+		Custom: map[string]string{"tmp": "", "source": "kromium"}}
+	src, err := storage.StatObject(context.Background(), config.sourceStorageProvider, config.SourceBucket, "0")
+	assert.NoError(t, err)
+	// The source is not actually a gzip, only the attributes are checked.
+	attrs := getDestinationAttrs(config, src, []transforms.Transform{transforms.GetTransform("GzipDecompress", nil)})
+	assert.Equal(t, "text/plain", attrs.ContentType)
+	assert.Equal(t, "", attrs.ContentEncoding)
+	assert.Equal(t, "max-age=60", attrs.CacheControl)
+	assert.Equal(t, map[string]string{"owner": "kromium", "source": "kromium"}, attrs.Metadata)
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// The default MirrorConfig.MaxDeletePercent.
+const cDefaultMaxDeletePercent = 10
+
+// Makes the destination an exact mirror of the source, by deleting the destination objects which are not written
+// from any source object once all the batches are done.
+type MirrorConfig struct {
+	Enabled bool
+	// The deletion is refused if it would delete more than this percentage of the destination objects, 10 by default.
+	MaxDeletePercent int
+	// Only reports the objects which would be deleted.
+	DryRun bool
+}
+
+func (m *MirrorConfig) maxDeletePercent() int {
+	if m.MaxDeletePercent <= 0 {
+		return cDefaultMaxDeletePercent
+	}
+	return m.MaxDeletePercent
+}
+
+// Returns the destination objects under the source prefix which are not the destination of any source object in the
+// manifest, in the order listed. With DestinationKey, the objects under the literal prefix of the template are listed
+// recursively instead, since the template can write them to any folder.
+func findOrphans(ctx context.Context, config *PipelineConfig) ([]string, int, error) {
+	destinations, err := config.getDestinations(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	expected := make(map[string]bool, len(destinations))
+	for _, name := range destinations {
+		expected[name] = true
+	}
+	prefix, delimiter := config.SourcePrefix, config.sourceDelimiter()
+	if config.destinationKey != nil {
+		prefix, delimiter = config.destinationKey.literalPrefix(), ""
+	}
+	objects, err := storage.ListObjects(ctx, config.destStorageProvider, config.DestinationBucket, prefix, delimiter)
+	if err != nil {
+		return nil, 0, err
+	}
+	var orphans []string
+	for _, o := range objects {
+		if !expected[o] {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans, len(objects), nil
+}
+
+// Deletes the orphaned destination objects, or only lists them in dry run mode. Returns the orphans.
+func mirrorDestination(ctx context.Context, config *PipelineConfig) ([]string, error) {
+	orphans, total, err := findOrphans(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Mirror.DryRun {
+		for _, o := range orphans {
+			log.Infof("[dry run] Would delete %s from %s", o, config.DestinationBucket)
+		}
+		return orphans, nil
+	}
+	if len(orphans)*100 > config.Mirror.maxDeletePercent()*total {
+		return orphans, fmt.Errorf("refusing to delete %d of the %d objects in %s, more than %d%%. Check the config "+
+			"with DryRun or raise MaxDeletePercent", len(orphans), total, config.DestinationBucket,
+			config.Mirror.maxDeletePercent())
+	}
+	for _, o := range orphans {
+		if err := storage.DeleteObject(ctx, config.destStorageProvider, config.DestinationBucket, o); err != nil {
+			return orphans, fmt.Errorf("failed to delete object %s/%s, %v", config.DestinationBucket, o, err)
+		}
+		log.Debugf("Deleted %s from %s", o, config.DestinationBucket)
+	}
+	return orphans, nil
+}
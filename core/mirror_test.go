@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func writeDestinationObjects(t *testing.T, config *PipelineConfig, names ...string) {
+	for _, name := range names {
+		w, err := storage.GetObjectWriter(context.Background(), config.destStorageProvider, config.DestinationBucket, name)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+}
+
+func TestMirrorDeletesOrphans(t *testing.T) {
+	config := setUpMemory(t, 20)
+	defer tearDownMemory(config)
+	config.NameSuffix = ".gz"
+	config.Mirror = MirrorConfig{Enabled: true}
+	writeDestinationObjects(t, config, "0.gz", "1", "old.gz")
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	var expected []string
+	for i := 0; i < 20; i++ {
+		expected = append(expected, fmt.Sprintf("%d.gz", i))
+	}
+	assert.ElementsMatch(t, expected, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	config := setUpMemory(t, 1)
+	defer tearDownMemory(config)
+	config.Mirror = MirrorConfig{Enabled: true, DryRun: true}
+	writeDestinationObjects(t, config, "a", "b")
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	orphans, err := mirrorDestination(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, orphans)
+	assert.Equal(t, []string{"0", "a", "b"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestMirrorRefusesToDeleteTooMany(t *testing.T) {
+	config := setUpMemory(t, 10)
+	defer tearDownMemory(config)
+	config.Mirror = MirrorConfig{Enabled: true}
+	writeDestinationObjects(t, config, "a", "b")
+
+	// 2 out of 12 objects.
+	assert.Error(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, 12, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+
+	config.Mirror.MaxDeletePercent = 20
+	_, err := mirrorDestination(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+}
+
+func TestMirrorOnlyDeletesUnderSourcePrefix(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	for _, name := range []string{"logs/a", "logs/b"} {
+		w, err := storage.GetObjectWriter(context.Background(), config.sourceStorageProvider, config.SourceBucket, name)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+	config.SourcePrefix = "logs/"
+	config.Mirror = MirrorConfig{Enabled: true, MaxDeletePercent: 100}
+	writeDestinationObjects(t, config, "logs/c", "logs/nested/d", "other")
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, []string{"logs/a", "logs/b", "other"},
+		listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestMirrorWithDestinationKey(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.DestinationKey = "archive/{{.Name}}/{{.Key}}.txt"
+	config.Mirror = MirrorConfig{Enabled: true, MaxDeletePercent: 100}
+	assert.NoError(t, config.Init(ctx))
+	writeDestinationObjects(t, config, "archive/0/0.txt", "archive/3/3.txt", "archive/old.txt", "other/4.txt")
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	assert.Equal(t, []string{"archive/0/0.txt", "archive/1/1.txt", "archive/2/2.txt", "other/4.txt"},
+		listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
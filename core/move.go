@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Returns true if the source object is still the one listed in the manifest. The times are compared at second
+// precision, which is all that some providers return on stat.
+func isUnchangedSinceListing(o storage.ObjectInfo, size int64, modTime time.Time) bool {
+	return o.Size == size && o.ModTime.Truncate(time.Second).Equal(modTime.Truncate(time.Second))
+}
+
+// Deletes the source objects of a processed batch. The objects which changed since they were listed are kept, since
+// what was processed may not be their latest version. Failures are only logged, the objects left behind are deleted
+// at the end of the run.
+func deleteProcessedSources(ctx context.Context, config *PipelineConfig, objects []storage.ObjectInfo) {
+	for _, o := range objects {
+		attrs, err := storage.StatObject(ctx, config.sourceStorageProvider, config.SourceBucket, o.Name)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to delete the processed source object %s, %v", o.Name, err)
+			continue
+		}
+		if !isUnchangedSinceListing(o, attrs.Size, attrs.ModTime) {
+			log.Warnf("Keeping the processed source object %s since it changed after it was listed", o.Name)
+			continue
+		}
+		if err := storage.DeleteObject(ctx, config.sourceStorageProvider, config.SourceBucket, o.Name); err != nil {
+			log.Warnf("Failed to delete the processed source object %s, %v", o.Name, err)
+		}
+	}
+}
+
+// Deletes the source objects in the manifest which are left behind by failed deletes or crashes after the batch was
+// checkpointed. Only called once all the batches are processed. Returns the number of objects deleted.
+func deleteRemainingSources(ctx context.Context, config *PipelineConfig) (int, error) {
+	m, err := config.getManifest(ctx)
+	if err != nil {
+		return 0, err
+	}
+	current, err := listSource(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	// The failed objects are kept for RetryFailed.
+	deadLettered, err := readDeadLetteredObjects(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	listed := make(map[string]storage.ObjectInfo, len(m.objects))
+	for _, o := range m.objects {
+		listed[o.Name] = o
+	}
+	deleted := 0
+	for _, o := range current.objects {
+		if l, ok := listed[o.Name]; !ok || deadLettered[o.Name] || !isUnchangedSinceListing(l, o.Size, o.ModTime) {
+			continue
+		}
+		if err := storage.DeleteObject(ctx, config.sourceStorageProvider, config.SourceBucket, o.Name); err != nil {
+			return deleted, fmt.Errorf("failed to delete the processed source object %s, %v", o.Name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Returns true if the current listing of the source only lacks objects of the manifest which were processed, and
+// so were deleted by DeleteSourceOnSuccess. The run can resume with the manifest then.
+func onlyProcessedSourcesRemoved(ctx context.Context, config *PipelineConfig, persisted *manifest, current *manifest) (bool, error) {
+	inManifest := make(map[string]bool, len(persisted.objects))
+	for _, o := range persisted.objects {
+		inManifest[o.Name] = true
+	}
+	remaining := make(map[string]bool, len(current.objects))
+	for _, o := range current.objects {
+		if !inManifest[o.Name] {
+			// New objects were added.
+			return false, nil
+		}
+		remaining[o.Name] = true
+	}
+	state, err := ReadMergedState(ctx, config, len(persisted.objects), persisted.fingerprint())
+	if err != nil {
+		return false, err
+	}
+	for i, o := range persisted.objects {
+		if !remaining[o.Name] && !state.m.isSet(i) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDeleteSourceOnSuccessMovesObjects(t *testing.T) {
+	config := setUpMemory(t, cBatchSize+5)
+	defer tearDownMemory(config)
+	config.DeleteSourceOnSuccess = true
+
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 2, false))
+	assert.Empty(t, listBucket(t, config.sourceStorageProvider, config.SourceBucket))
+	assert.Equal(t, cBatchSize+5, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+}
+
+func TestDeleteSourceOnSuccessResumesAfterMovingSomeBatches(t *testing.T) {
+	config := setUpMemory(t, 2*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.DeleteSourceOnSuccess = true
+
+	c, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cBatchSize, c)
+	assert.Equal(t, cBatchSize, len(listBucket(t, config.sourceStorageProvider, config.SourceBucket)))
+
+	// A restarted run sees a source listing without the moved objects.
+	config.run = &pipelineRun{}
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	assert.Empty(t, listBucket(t, config.sourceStorageProvider, config.SourceBucket))
+	assert.Equal(t, 2*cBatchSize, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+}
+
+func TestDeleteSourceOnSuccessKeepsFailedObject(t *testing.T) {
+	config := setUpMemory(t, cBatchSize)
+	defer tearDownMemory(config)
+	config.DeleteSourceOnSuccess = true
+	// The failed read is not retried, so that the object fails.
+	config.Retry.MaxAttempts = 1
+
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{FailReadN: 3})
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(listBucket(t, config.sourceStorageProvider, config.SourceBucket)))
+}
+
+func TestDeleteSourceOnSuccessKeepsChangedObjects(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.DeleteSourceOnSuccess = true
+	_, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+
+	// Overwritten after the listing.
+	w, err := storage.GetObjectWriter(ctx, config.sourceStorageProvider, config.SourceBucket, "1")
+	assert.NoError(t, err)
+	w.Write([]byte("changed\n"))
+	assert.NoError(t, w.Close())
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	assert.Equal(t, []string{"1"}, listBucket(t, config.sourceStorageProvider, config.SourceBucket))
+}
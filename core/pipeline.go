@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
@@ -10,6 +11,7 @@ import (
 	"github.com/sharvanath/kromium/transforms"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"runtime/trace"
 	"strings"
 	"sync"
@@ -61,66 +63,163 @@ func getObjectName(object string, nameSuffix string, stripSuffix string) string
 	return strings.TrimSuffix(object, stripSuffix) + nameSuffix
 }
 
-func processObjectInPipeline(ctx context.Context, config *PipelineConfig, threadIdx int, object string) error {
+// The outcome of processing an object.
+type objectResult struct {
+	// The destination object was up to date (in sync mode) or the source was already moved.
+	skipped bool
+	// The checksums of the source and destination, only with Verify.
+	audit *auditRecord
+	// The number of attempts made.
+	attempts int
+	// Set if the object failed and was dead-lettered.
+	deadLetter *deadLetterRecord
+}
+
+func processObjectInPipeline(ctx context.Context, config *PipelineConfig, threadIdx int, object string, dstObjectName string) (objectResult, error) {
+	var result objectResult
+	var stages []transforms.Transform
+	for _, t := range config.Transforms {
+		transform := transforms.GetTransform(t.Type, t.Args)
+		if transform == nil {
+			return result, fmt.Errorf("could not find transform %s", t.Type)
+		}
+		stages = append(stages, transform)
+	}
+
+	// The destination is checked before the sources are deleted.
+	verify := config.Verify || config.DeleteSourceOnSuccess
+	var srcAttrs *storage.ObjectAttrs
+	if config.Metadata.copiesSource() || config.Mode == cModeSync || verify {
+		var err error
+		srcAttrs, err = storage.StatObject(ctx, config.sourceStorageProvider, config.SourceBucket, object)
+		// Workers can pick the same batch, and the one which finished first deleted the sources.
+		if config.DeleteSourceOnSuccess && errors.Is(err, storage.ErrObjectNotExist) {
+			log.Warnf("[Worker %d] Skipped object: %s, it no longer exists and is assumed moved by another worker", threadIdx, object)
+			result.skipped = true
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	if config.Mode == cModeSync {
+		synced, err := isObjectSynced(ctx, config, srcAttrs, dstObjectName)
+		if err != nil {
+			return result, err
+		}
+		if synced {
+			log.Debugf("[Worker %d] Skipped object: %s, %s is up to date\n", threadIdx, object, dstObjectName)
+			result.skipped = true
+			return result, nil
+		}
+	}
+
+	attrs := getDestinationAttrs(config, srcAttrs, stages)
 	srcObjectCloser, err := storage.GetObjectReader(ctx, config.sourceStorageProvider, config.SourceBucket, object)
 	if err != nil {
-		return err
+		return result, err
 	}
-	dstObjectName := getObjectName(object, config.NameSuffix, config.StripSuffix)
-	dstObjectCloser, err := storage.GetObjectWriter(ctx, config.destStorageProvider, config.DestinationBucket, dstObjectName)
+	defer srcObjectCloser.Close()
+	dstObjectCloser, err := storage.GetObjectWriterWithAttrs(ctx, config.destStorageProvider, config.DestinationBucket, dstObjectName, attrs)
 	if err != nil {
-		srcObjectCloser.Close()
-		return err
+		return result, err
+	}
+
+	var srcReader io.Reader = storageIOReader{srcObjectCloser}
+	var dstWriter io.Writer = storageIOWriter{dstObjectCloser}
+	var srcChecksums, dstChecksums *checksums
+	if verify {
+		srcChecksums = newChecksums()
+		srcReader = io.TeeReader(srcReader, srcChecksums)
+		dstChecksums = newChecksums()
+		dstWriter = io.MultiWriter(dstWriter, dstChecksums)
 	}
 
-	var lastPipeReadEnd io.Reader
 	// A pipeline of transforms, chained. Each stage is connected by a pipe, so the writer end must close otherwise
-	// the read will keep hanging.
-	var pipelineError atomic.Value
+	// the read will keep hanging. A failed stage closes both its pipes with the error, so that the stages before and
+	// after it fail too rather than hang or see a clean EOF.
+	var pipelineError error
+	var errLock sync.Mutex
 	var wg sync.WaitGroup
+	var lastPipeReadEnd *io.PipeReader
 
-	for idx, t := range config.Transforms {
-		var src io.Reader
-		var dst io.WriteCloser
-		transform := transforms.GetTransform(t.Type, t.Args)
-		// Stop building the pipeline. srcObjectCloser.Close() will trigger the close of the full chain.
-		if transform == nil {
-			err = fmt.Errorf("could not find transform %s", t.Type)
-			dstObjectCloser.Close()
-			break
-		}
-
-		if idx == 0 {
-			src = srcObjectCloser
-		} else {
-			src = lastPipeReadEnd
+	for idx, transform := range stages {
+		var src io.Reader = srcReader
+		srcPipe := lastPipeReadEnd
+		if srcPipe != nil {
+			src = srcPipe
 		}
-
-		if idx == len(config.Transforms)-1 {
-			dst = dstObjectCloser
-		} else {
-			lastPipeReadEnd, dst = io.Pipe()
+		var dst io.Writer = dstWriter
+		var dstPipe *io.PipeWriter
+		if idx < len(stages)-1 {
+			lastPipeReadEnd, dstPipe = io.Pipe()
+			dst = dstPipe
 		}
 
 		wg.Add(1)
-		go func(dst io.WriteCloser, src io.Reader, t TransformConfig) {
+		go func(idx int, transform transforms.Transform, dst io.Writer, src io.Reader, srcPipe *io.PipeReader, dstPipe *io.PipeWriter, t TransformConfig) {
+			defer wg.Done()
 			log.Debugf("[Worker %d] Apply transform [%2d] %15s.", threadIdx, idx, t)
-			if _, localErr := transform.Transform(dst, src);  localErr != nil {
-				pipelineError.Store(localErr)
+			_, localErr := transform.Transform(dst, src)
+			if localErr != nil {
+				localErr = &transformError{index: idx, transform: t.Type, err: localErr}
+				errLock.Lock()
+				// Keep the first error, the others are usually caused by it.
+				if pipelineError == nil {
+					pipelineError = localErr
+				}
+				errLock.Unlock()
 				log.Warnf("[Worker %d] Apply transform [%2d] %15s failed on %s.", threadIdx, idx, t, object)
+				if srcPipe != nil {
+					srcPipe.CloseWithError(localErr)
+				}
+			}
+			// The destination object is closed or aborted only once all the stages are done.
+			if dstPipe != nil {
+				dstPipe.CloseWithError(localErr)
 			}
-			dst.Close()
-			wg.Done()
-		}(dst, src, t)
+		}(idx, transform, dst, src, srcPipe, dstPipe, config.Transforms[idx])
 	}
 
 	wg.Wait()
-	if pipelineError.Load() != nil {
-		err = pipelineError.Load().(error)
-		log.Warnf("[Worker %d] Failed during pipeline %s", threadIdx, err)
+	var srcVerified []string
+	if pipelineError == nil && verify {
+		// The transforms need not read the source to the end, e.g. the trailing garbage after a gzip stream.
+		if _, err := io.Copy(ioutil.Discard, srcReader); err != nil {
+			pipelineError = err
+		} else {
+			srcVerified, pipelineError = srcChecksums.verify(srcAttrs, config.SourceBucket, object)
+		}
+	}
+	if pipelineError != nil {
+		log.Warnf("[Worker %d] Failed during pipeline %s", threadIdx, pipelineError)
+		// Never publish a partial object.
+		if err := dstObjectCloser.Abort(pipelineError); err != nil {
+			log.Warnf("[Worker %d] Failed to abort the write of %s %v", threadIdx, dstObjectName, err)
+		}
+		return result, pipelineError
+	}
+	if err := dstObjectCloser.Close(); err != nil {
+		return result, fmt.Errorf("failed to write object %s to %s, %w", dstObjectName, config.DestinationBucket, err)
 	}
 	log.Debugf("[Worker %d] Wrote object: %s to bucket: %s\n", threadIdx, dstObjectName, config.DestinationBucket)
-	return err
+	if !verify {
+		return result, nil
+	}
+	stored, err := storage.StatObject(ctx, config.destStorageProvider, config.DestinationBucket, dstObjectName)
+	if err != nil {
+		return result, fmt.Errorf("failed to verify object %s/%s, %w", config.DestinationBucket, dstObjectName, err)
+	}
+	dstVerified, err := dstChecksums.verify(stored, config.DestinationBucket, dstObjectName)
+	if err != nil {
+		return result, err
+	}
+	if config.Verify {
+		result.audit = newAuditRecord(object, dstObjectName, srcChecksums, dstChecksums)
+		result.audit.SourceVerified = srcVerified
+		result.audit.DestinationVerified = dstVerified
+	}
+	return result, nil
 }
 
 // Returns the number of files copied, and error if it fails.
@@ -128,73 +227,144 @@ func RunPipeline(ctx context.Context, config *PipelineConfig, threadIdx int, ren
 	defer trace.StartRegion(ctx, "RunPipeline").End()
 
 	copied := 0
-	files, err := storage.ListObjects(ctx, config.sourceStorageProvider, config.SourceBucket)
+	m, err := config.getManifest(ctx)
 	if err != nil {
 		return copied, err
 	}
+	files := m.names()
 
 	if len(config.Transforms) == 0 || len(files) == 0  {
 		return copied, fmt.Errorf("NOOP: Empty pipeline")
 	}
 
-	workerState, err := ReadMergedState(ctx, config, len(files))
-
+	batches, err := config.getBatches(ctx)
+	if err != nil {
+		return copied, err
+	}
+	destinations, err := config.getDestinations(ctx)
+	if err != nil {
+		return copied, err
+	}
+	workerId := uuid.New().String()
+	workerState, start, end, claimed, err := claimProcessingRange(ctx, config, m, batches, workerId)
 	if err != nil {
 		return copied, err
 	}
-
-	start, end := workerState.findProcessingRange()
 	if start == -1 {
 		log.Debugf("[Worker %d] All files have been processed. %d\n", threadIdx, len(files))
 		return copied, nil
 	}
+	// Only once the state is written, so that the next holder of the batch sees what was processed.
+	if claimed != nil {
+		defer claimed.release(ctx)
+	}
 
-	workerId := uuid.New().String()
 	log.Debugf("[Worker %d] Starting worker %s with index range %d:%d\n", threadIdx, workerId, start, end)
 	var channels []chan error
+	var indexes []int
+	results := make([]objectResult, end-start)
 
-	for _, o1 := range files[start:end] {
+	for i := start; i < end; i++ {
+		// Only the objects which are not processed yet, a batch can be partially processed.
+		if workerState.m.isSet(i) {
+			continue
+		}
+		o1 := files[i]
 		log.Debugf("[Worker %d] Processing object: %s from bucket: %s\n", threadIdx, o1, config.SourceBucket)
-		var err error
-		var srcCloser io.ReadCloser
-		var dstCloser io.WriteCloser
-
 		channel := make(chan error)
 		channels = append(channels, channel)
-		go func(o string, c chan error) {
-			err = processObjectInPipeline(ctx, config, threadIdx, o)
-			if err != nil {
+		indexes = append(indexes, i)
+		go func(o string, dst string, result *objectResult, c chan error) {
+			var err error
+			if dst == "" {
+				log.Debugf("[Worker %d] Skipped object: %s, its destination name collides with another object", threadIdx, o)
+				result.skipped = true
+			} else {
+				*result, err = processObjectWithRetries(ctx, config, threadIdx, o, dst)
+			}
+			// The dead-letter log keeps the skipped objects apart from the processed ones. Only the objects which
+			// failed for good are skipped, the ones interrupted by a shutdown are processed again by the next run.
+			final := ctx.Err() == nil && (!isRetryable(err) || result.attempts >= config.Retry.maxAttempts())
+			if err != nil && final && (config.DeadLetter.Enabled || (!isRetryable(err) && config.Retry.OnPermanentFailure == cPermanentFailureSkip)) {
+				log.Errorf("[Worker %d] Skipped object: %s after %d attempts, %v", threadIdx, o, result.attempts, err)
+				result.deadLetter = deadLetterObject(ctx, config, o, result.attempts, err)
+				atomic.AddInt64(&config.run.failed, 1)
+				err = nil
+			} else if err != nil {
 				log.Warnf("[Worker %d] Failed during pipeline %s", threadIdx, err)
-				if srcCloser != nil {
-					srcCloser.Close()
-				}
-				if dstCloser != nil {
-					dstCloser.Close()
-				}
+			} else if result.skipped {
+				atomic.AddInt64(&config.run.skipped, 1)
+			} else {
+				atomic.AddInt64(&config.run.copied, 1)
 			}
 			c <- err
-		}(o1, channel)
+		}(o1, destinations[o1], &results[i-start], channel)
 	}
 
-	for _, c := range channels {
+	// Wait for all the objects, the ones still running would keep writing otherwise. The ones which succeeded are
+	// checkpointed even if others failed.
+	var batchErr error
+	var succeeded []int
+	for i, c := range channels {
 		e := <- c
 		if e != nil {
-			return copied, e
+			if batchErr == nil {
+				batchErr = e
+			}
+			continue
 		}
+		succeeded = append(succeeded, indexes[i])
 		copied += 1
 	}
+	if len(succeeded) == 0 {
+		return copied, batchErr
+	}
+
+	var deadLetters []*deadLetterRecord
+	var audits []*auditRecord
+	var processed []storage.ObjectInfo
+	for _, i := range succeeded {
+		r := results[i-start]
+		if r.deadLetter != nil {
+			deadLetters = append(deadLetters, r.deadLetter)
+		} else {
+			processed = append(processed, m.objects[i])
+		}
+		if r.audit != nil {
+			audits = append(audits, r.audit)
+		}
+	}
+	if len(deadLetters) > 0 {
+		if err := writeDeadLetters(ctx, config, deadLetterFileName(config, start, workerId), deadLetters); err != nil {
+			return copied, err
+		}
+	}
+	if config.Verify {
+		if err := writeAudit(ctx, config, auditFileName(config, start, workerId), audits); err != nil {
+			return copied, err
+		}
+	}
 
-	workerState.setProcessed(start)
+	for _, i := range succeeded {
+		workerState.setProcessed(i)
+	}
 	workerState.workerId = workerId
 
-	numProcessed := workerState.m.usedSize()*cBatchSize
-	numTotal := len(workerState.m.slice)*cBatchSize*8
+	numProcessed := workerState.m.usedSize()
+	numTotal := workerState.m.size
 	if !renderUi {
 		log.Infof("[%s] [%d] Done %d/%d", time.Now().Format("2006-01-02 15:04:05.00"), threadIdx, numProcessed, numTotal)
 	}
 	updateStatus((numProcessed*100)/numTotal, fmt.Sprintf("Processed %d/%d", numProcessed, numTotal), renderUi)
 	fmt.Printf("%d", copied)
-	return copied, WriteState(ctx, config.StateBucket, workerState)
+	if err := WriteState(ctx, config.StateBucket, workerState); err != nil {
+		return copied, err
+	}
+	// Only once the objects are checkpointed, so that a crash never loses an object which was not processed.
+	if config.DeleteSourceOnSuccess {
+		deleteProcessedSources(ctx, config, processed)
+	}
+	return copied, batchErr
 }
 
 func runPipelineLoopInternal(ctx context.Context, config *PipelineConfig, channel chan error, threadIdx int, renderUi bool) {
@@ -236,6 +406,11 @@ func RunPipelineLoop(ctx context.Context, config *PipelineConfig, parallelism in
 		return fmt.Errorf("illegal parallelism: %d", parallelism)
 	}
 
+	// List the source once upfront, the workers share the manifest.
+	if _, err := config.getManifest(ctx); err != nil {
+		return err
+	}
+
 	start := time.Now()
 	var channels []chan error
 	for i := 0; i < parallelism; i += 1 {
@@ -255,5 +430,32 @@ func RunPipelineLoop(ctx context.Context, config *PipelineConfig, parallelism in
 		ui.Close()
 	}
 	fmt.Printf("Processed %d files in %.2f seconds\n", processedCount, time.Since(start).Seconds())
+	copied, skipped, failed := config.run.counts()
+	if config.Mode == cModeSync {
+		fmt.Printf("Copied %d files, skipped %d files which were up to date\n", copied, skipped)
+	}
+	if failed > 0 {
+		fmt.Printf("Skipped %d files which failed, they are listed in the dead-letter log in %s\n", failed, config.StateBucket)
+	}
+	if config.DeleteSourceOnSuccess {
+		deleted, err := deleteRemainingSources(ctx, config)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Infof("Deleted %d processed source objects left behind", deleted)
+		}
+	}
+	if config.Mirror.Enabled {
+		orphans, err := mirrorDestination(ctx, config)
+		if err != nil {
+			return err
+		}
+		if config.Mirror.DryRun {
+			fmt.Printf("Would delete %d files from %s which are not in the source\n", len(orphans), config.DestinationBucket)
+		} else {
+			fmt.Printf("Deleted %d files from %s which are not in the source\n", len(orphans), config.DestinationBucket)
+		}
+	}
 	return nil
 }
\ No newline at end of file
@@ -2,10 +2,17 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"github.com/sharvanath/kromium/storage"
-	"log"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// The temp files of interrupted writes are cleaned up only after this long without modification.
+const cStaleTempFileAge = time.Hour
+
 type TransformConfig struct {
 	Type string
 	Args interface{}
@@ -15,9 +22,46 @@ type PipelineConfig struct {
 	SourceBucket      string
 	DestinationBucket string
 	StateBucket       string
+	// Only the source objects with names starting with SourcePrefix are processed.
+	SourcePrefix      string
+	// If set, only the objects directly under SourcePrefix are processed, not the ones in nested folders.
+	NonRecursive      bool
+	// What to do when the source objects changed since the job started: "fail" (default) or "replan".
+	OnSourceChange    string
 	NameSuffix        string
 	StripSuffix       string
+	// A Go template of the destination key of every source object, e.g. "{{.ModTime.Format \"2006/01/02\"}}/{{.Base}}".
+	// It replaces NameSuffix and StripSuffix, see destinationKeyData for the values it can use.
+	DestinationKey    string
+	// A regular expression matched against the source key, the captures of which DestinationKey can use.
+	DestinationKeyPattern string
+	// What to do when more than one source object has the same destination name: "fail" (default), "skip", "hash"
+	// or "overwrite".
+	OnNameCollision   string
 	Transforms        []TransformConfig
+	// "copy" (default) writes every source object, "sync" skips the ones whose destination object is up to date.
+	Mode              string
+	// How the attributes of the source objects are carried over to the destination objects.
+	Metadata          MetadataConfig
+	Mirror            MirrorConfig
+	// Deletes the source objects once they are processed and the destination objects are verified, i.e. moves them.
+	DeleteSourceOnSuccess bool
+	// Computes the CRC32C, MD5 and SHA-256 of the source and destination content of every object, compares them with
+	// the checksums returned by the providers and records them in an audit file per batch in the state bucket.
+	Verify            bool
+	Retry             RetryConfig
+	DeadLetter        DeadLetterConfig
+	Lease             LeaseConfig
+	// The maximum number of objects in a batch, 16 by default. A batch is the unit of work a worker picks, and its
+	// objects are processed in parallel.
+	BatchSize         int
+	// If set, a batch also ends before its objects add up to more than this many bytes, so that the batches of large
+	// objects are not much bigger than the others. An object larger than it gets a batch of its own.
+	BatchBytes        int64
+	// Removes the temp files left behind by the interrupted writes of earlier runs (on file:// and sftp://) from the
+	// destination and state buckets when the pipeline starts. It walks the whole buckets, so it should only be set when
+	// they are not shared with other writers.
+	CleanTempFiles    bool
 	StorageConfig     storage.StorageConfig
 
 	// Derived fields
@@ -25,6 +69,28 @@ type PipelineConfig struct {
 	sourceStorageProvider storage.StorageProvider
 	destStorageProvider storage.StorageProvider
 	stateStorageProvider storage.StorageProvider
+	quarantineStorageProvider storage.StorageProvider
+	destinationKey            *destinationKey
+	run                   *pipelineRun
+}
+
+// The in-memory state shared by all the workers of a run.
+type pipelineRun struct {
+	// The number of objects written, skipped and failed (permanently, with OnPermanentFailure: "skip"), updated
+	// atomically.
+	copied   int64
+	skipped  int64
+	failed   int64
+	sync.Mutex
+	manifest *manifest
+	// The start indexes of the batches in the manifest.
+	batches  []int
+	// The destination name of every source object in the manifest.
+	destinations map[string]string
+}
+
+func (r *pipelineRun) counts() (int64, int64, int64) {
+	return atomic.LoadInt64(&r.copied), atomic.LoadInt64(&r.skipped), atomic.LoadInt64(&r.failed)
 }
 
 func (p *PipelineConfig) getHash() string {
@@ -34,7 +100,103 @@ func (p *PipelineConfig) getHash() string {
 	return p.Hash
 }
 
+// Returns the manifest of the run, loading or creating it on the first call.
+func (p *PipelineConfig) getManifest(ctx context.Context) (*manifest, error) {
+	p.run.Lock()
+	defer p.run.Unlock()
+	if p.run.manifest != nil {
+		return p.run.manifest, nil
+	}
+	m, err := loadOrCreateManifest(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	// An empty listing is not cached so that the next call lists the source again.
+	if len(m.objects) > 0 {
+		p.run.manifest = m
+	}
+	return m, nil
+}
+
+// Returns the start indexes of the batches of the manifest.
+func (p *PipelineConfig) getBatches(ctx context.Context) ([]int, error) {
+	m, err := p.getManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.run.Lock()
+	defer p.run.Unlock()
+	// An empty manifest is not cached.
+	if p.run.manifest != m {
+		return m.batches(p.BatchSize, p.BatchBytes), nil
+	}
+	if p.run.batches == nil {
+		p.run.batches = m.batches(p.BatchSize, p.BatchBytes)
+	}
+	return p.run.batches, nil
+}
+
+// Returns the destination name of every source object in the manifest, empty for the ones which are skipped since
+// their name collides with another one.
+func (p *PipelineConfig) getDestinations(ctx context.Context) (map[string]string, error) {
+	m, err := p.getManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.run.Lock()
+	defer p.run.Unlock()
+	// An empty manifest is not cached.
+	if p.run.manifest != m {
+		return resolveDestinations(p, m)
+	}
+	if p.run.destinations == nil {
+		if p.run.destinations, err = resolveDestinations(p, m); err != nil {
+			return nil, err
+		}
+	}
+	return p.run.destinations, nil
+}
+
+// The delimiter used for listing the source bucket.
+func (p *PipelineConfig) sourceDelimiter() string {
+	if p.NonRecursive {
+		return "/"
+	}
+	return ""
+}
+
 func (p *PipelineConfig) Init(ctx context.Context) error {
+	return p.init(ctx, false)
+}
+
+// Initializes the config without writing to any bucket, e.g. for planning a run. The stale temp files of the
+// interrupted writes are not cleaned up, even with CleanTempFiles.
+func (p *PipelineConfig) InitReadOnly(ctx context.Context) error {
+	return p.init(ctx, true)
+}
+
+func (p *PipelineConfig) init(ctx context.Context, readOnly bool) error {
+	if err := p.Retry.validate(); err != nil {
+		return err
+	}
+	if err := p.Lease.validate(); err != nil {
+		return err
+	}
+	if err := validateNameCollision(p.OnNameCollision, p.DeleteSourceOnSuccess); err != nil {
+		return err
+	}
+	destinationKey, err := newDestinationKey(p)
+	if err != nil {
+		return err
+	}
+	p.destinationKey = destinationKey
+	if p.BatchSize < 0 || p.BatchBytes < 0 {
+		return fmt.Errorf("illegal batch size %d or batch bytes %d", p.BatchSize, p.BatchBytes)
+	}
+	// The state files would be deleted as orphans.
+	if p.Mirror.Enabled && p.DestinationBucket == p.StateBucket {
+		return fmt.Errorf("mirror mode needs a state bucket different from the destination bucket %s", p.DestinationBucket)
+	}
 	inputStorageProvider, err := storage.GetStorageProvider(ctx, p.SourceBucket, &p.StorageConfig)
 	if err != nil {
 		return err
@@ -52,15 +214,52 @@ func (p *PipelineConfig) Init(ctx context.Context) error {
 		return err
 	}
 	p.stateStorageProvider = stateStorageProvider
+	if p.Lease.Enabled && !storage.CanCreateObject(stateStorageProvider) {
+		return fmt.Errorf("leases need a state bucket which supports conditional creates, %s does not", p.StateBucket)
+	}
 
-	h := newSha1Hasher()
-	h.addStr(p.SourceBucket)
-	h.addStr(p.DestinationBucket)
-	h.addStr(p.NameSuffix)
-	for _, t := range p.Transforms {
-		h.addStr(t.Type)
+	if p.DeadLetter.QuarantineBucket != "" {
+		quarantineStorageProvider, err := storage.GetStorageProvider(ctx, p.DeadLetter.QuarantineBucket, &p.StorageConfig)
+		if err != nil {
+			return err
+		}
+		p.quarantineStorageProvider = quarantineStorageProvider
 	}
-	p.Hash = h.getStrHash()
+	for _, b := range []struct {
+		name     string
+		bucket   string
+		provider storage.StorageProvider
+	}{{"destination", p.DestinationBucket, p.destStorageProvider}, {"state", p.StateBucket, p.stateStorageProvider},
+		{"quarantine", p.DeadLetter.QuarantineBucket, p.quarantineStorageProvider}} {
+		if b.provider != nil && storage.IsReadOnly(b.provider) {
+			return fmt.Errorf("the %s bucket %s is read-only", b.name, b.bucket)
+		}
+	}
+	if p.DeleteSourceOnSuccess && storage.IsReadOnly(p.sourceStorageProvider) {
+		return fmt.Errorf("DeleteSourceOnSuccess cannot be used with the read-only source bucket %s", p.SourceBucket)
+	}
+
+	if p.CleanTempFiles && !readOnly {
+		// Clean up after any previous run which crashed midway through writing an object.
+		for _, b := range []struct {
+			bucket   string
+			provider storage.StorageProvider
+		}{{p.DestinationBucket, p.destStorageProvider}, {p.StateBucket, p.stateStorageProvider}} {
+			n, err := storage.CleanTempFiles(ctx, b.provider, b.bucket, cStaleTempFileAge)
+			if err != nil {
+				log.Warnf("Failed to clean up the temp files in %s, %v", b.bucket, err)
+			} else if n > 0 {
+				log.Infof("Removed %d stale temp files from %s", n, b.bucket)
+			}
+		}
+	}
+
+	record, err := newConfigRecord(p)
+	if err != nil {
+		return err
+	}
+	p.Hash = record.hash()
+	p.run = &pipelineRun{}
 	return nil
 }
 
@@ -83,5 +282,11 @@ func (p *PipelineConfig) Close() error {
 		}
 	}
 
+	if p.quarantineStorageProvider != nil {
+		if err := p.quarantineStorageProvider.Close(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
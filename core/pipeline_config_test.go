@@ -4,14 +4,21 @@ import (
 	"context"
 	"github.com/sharvanath/kromium/storage"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func getIdentityPipelineConfig(src string, dst string, state string) *PipelineConfig {
+	return getIdentityPipelineConfigForUris("file://"+src, "file://"+dst, "file://"+state)
+}
+
+func getIdentityPipelineConfigForUris(src string, dst string, state string) *PipelineConfig {
 	config := PipelineConfig{}
-	config.SourceBucket = "file://" + src
-	config.DestinationBucket = "file://" + dst
-	config.StateBucket = "file://" + state
+	config.SourceBucket = src
+	config.DestinationBucket = dst
+	config.StateBucket = state
 	config.NameSuffix = ""
 
 	var err error
@@ -46,3 +53,36 @@ func TestConfigHashEqualDifferentStateBucket(t *testing.T) {
 	config2.Init(context.Background())
 	assert.Equal(t, config1.getHash(), config2.getHash())
 }
+
+func TestHttpBucketsAreOnlyValidAsSource(t *testing.T) {
+	for _, c := range []*PipelineConfig{
+		{SourceBucket: "mem://src", DestinationBucket: "https://example.com/dst", StateBucket: "mem://state"},
+		{SourceBucket: "mem://src", DestinationBucket: "mem://dst", StateBucket: "https://example.com/state"},
+		{SourceBucket: "https://example.com/src", DestinationBucket: "mem://dst", StateBucket: "mem://state",
+			DeleteSourceOnSuccess: true},
+	} {
+		assert.Error(t, c.Init(context.Background()))
+	}
+	config := &PipelineConfig{SourceBucket: "https://example.com/src", DestinationBucket: "mem://dst",
+		StateBucket: "mem://state"}
+	assert.NoError(t, config.Init(context.Background()))
+}
+
+func TestStaleTempFilesAreOnlyCleanedIfEnabled(t *testing.T) {
+	setUp(1)
+	defer tearDown()
+	stale := dst_dir + "/.kromium-tmp-stale"
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("partial"), 0600))
+	old := time.Now().Add(-2 * cStaleTempFileAge)
+	assert.NoError(t, os.Chtimes(stale, old, old))
+
+	config := getPipelineConfig()
+	assert.NoError(t, config.Init(context.Background()))
+	_, err := os.Stat(stale)
+	assert.NoError(t, err)
+
+	config.CleanTempFiles = true
+	assert.NoError(t, config.Init(context.Background()))
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+}
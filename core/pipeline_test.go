@@ -1,11 +1,16 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"github.com/sharvanath/kromium/storage"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -202,4 +207,172 @@ func TestRunIdentityPipelineLargeParallel(t *testing.T) {
 	filesDst, err := getFilesToMtime(dst_dir)
 	assert.NoError(t, err, "test error")
 	assert.Equal(t, getKeyMap(files), getKeyMap(filesDst))
-}
\ No newline at end of file
+}
+func createNestedFile(t *testing.T, name string) {
+	path := src_dir + "/" + name
+	assert.NoError(t, os.MkdirAll(path[:strings.LastIndex(path, "/")], 0700))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("test\n"), 0700))
+}
+
+func TestRunPipelineSkipsNestedIfNonRecursive(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	createNestedFile(t, "sub/nested")
+	ctx := context.Background()
+	config := getPipelineConfig()
+	config.NonRecursive = true
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	filesDst, err := getFilesToMtime(dst_dir)
+	assert.NoError(t, err, "test error")
+	assert.Equal(t, map[string]bool{"0": true, "1": true, "2": true}, getKeyMap(filesDst))
+}
+
+// The configs written before SourcePrefix was added list the whole bucket, like the GCS and S3 listings did.
+func TestRunPipelineIncludesNestedByDefault(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	createNestedFile(t, "sub/nested")
+	ctx := context.Background()
+	assert.NoError(t, RunPipelineLoop(ctx, getPipelineConfig(), 1, false))
+	_, err := os.Stat(dst_dir + "/sub/nested")
+	assert.NoError(t, err)
+}
+
+func TestRunPipelineRecursiveWithPrefix(t *testing.T) {
+	setUp(3)
+	defer tearDown()
+	createNestedFile(t, "sub/a")
+	createNestedFile(t, "sub/nested/b")
+	createNestedFile(t, "other/c")
+	ctx := context.Background()
+	config := getPipelineConfig()
+	config.SourcePrefix = "sub/"
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+
+	filesDst, err := getFilesToMtime(dst_dir)
+	assert.NoError(t, err, "test error")
+	assert.Equal(t, map[string]bool{"sub": true}, getKeyMap(filesDst))
+	_, err = os.Stat(dst_dir + "/sub/a")
+	assert.NoError(t, err)
+	_, err = os.Stat(dst_dir + "/sub/nested/b")
+	assert.NoError(t, err)
+}
+
+// Creates the source objects in a memory bucket, and returns the pipeline reading from it.
+func setUpMemory(t *testing.T, numFiles int) *PipelineConfig {
+	name := randSeq(8)
+	config := getIdentityPipelineConfigForUris("mem://"+name+"_src", "mem://"+name+"_dst", "mem://"+name+"_state")
+	for i := 0; i < numFiles; i++ {
+		w, err := storage.GetObjectWriter(context.Background(), config.sourceStorageProvider, config.SourceBucket, fmt.Sprintf("%d", i))
+		assert.NoError(t, err)
+		w.Write([]byte("test\n"))
+		assert.NoError(t, w.Close())
+	}
+	return config
+}
+
+func tearDownMemory(config *PipelineConfig) {
+	storage.ResetMemoryBucket(config.SourceBucket)
+	storage.ResetMemoryBucket(config.DestinationBucket)
+	storage.ResetMemoryBucket(config.StateBucket)
+}
+
+func listBucket(t *testing.T, p storage.StorageProvider, bucket string) []string {
+	objects, err := storage.ListObjects(context.Background(), p, bucket, "", "")
+	assert.NoError(t, err)
+	return objects
+}
+
+func TestFailedReadIsNotCheckpointed(t *testing.T) {
+	config := setUpMemory(t, cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	// The failed read is not retried, so that the object fails.
+	config.Retry.MaxAttempts = 1
+
+	// The other objects of the batch are checkpointed.
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{FailReadN: 3})
+	c, err := RunPipeline(ctx, config, 0, false)
+	assert.Error(t, err)
+	assert.Equal(t, cBatchSize-1, c)
+	// The config record, the manifest and the state file.
+	assert.Equal(t, 3, len(listBucket(t, config.stateStorageProvider, config.StateBucket)))
+
+	c, err = RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c)
+	assert.Equal(t, cBatchSize, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+	assert.Equal(t, 3, len(listBucket(t, config.stateStorageProvider, config.StateBucket)))
+}
+
+func TestObjectDeletedAfterListingFailsRun(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{DeleteDuringList: []string{"1"}})
+	assert.Error(t, RunPipelineLoop(context.Background(), config, 1, false))
+	w, err := ReadMergedState(context.Background(), config, 3, config.run.manifest.fingerprint())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, w.m.usedSize())
+	assert.False(t, w.m.isSet(1))
+}
+
+func TestSlowDestinationWithParallelWorkers(t *testing.T) {
+	config := setUpMemory(t, 4*cBatchSize)
+	defer tearDownMemory(config)
+
+	storage.SetMemoryFaults(config.DestinationBucket, storage.MemoryFaults{WriteDelay: time.Millisecond})
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 4, false))
+	assert.Equal(t, 4*cBatchSize, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+	m, err := config.getManifest(context.Background())
+	assert.NoError(t, err)
+	w, err := ReadMergedState(context.Background(), config, len(m.objects), m.fingerprint())
+	assert.NoError(t, err)
+	assert.Equal(t, 4*cBatchSize, w.m.usedSize())
+}
+
+// Writes a gzip of the content as object 0 of the source, truncated so that decompressing it fails midway.
+func writeTruncatedGzip(t *testing.T, config *PipelineConfig) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(randSeq(100000)))
+	assert.NoError(t, gz.Close())
+	w, err := storage.GetObjectWriter(context.Background(), config.sourceStorageProvider, config.SourceBucket, "0")
+	assert.NoError(t, err)
+	w.Write(buf.Bytes()[:buf.Len()/2])
+	assert.NoError(t, w.Close())
+}
+
+func TestFailedTransformIsNotPublished(t *testing.T) {
+	for _, types := range [][]string{{"GzipDecompress"}, {"GzipDecompress", "Identity"}, {"Identity", "GzipDecompress", "Identity"}} {
+		config := setUpMemory(t, 1)
+		writeTruncatedGzip(t, config)
+		config.Transforms = nil
+		for _, tp := range types {
+			config.Transforms = append(config.Transforms, TransformConfig{Type: tp})
+		}
+
+		_, err := RunPipeline(context.Background(), config, 0, false)
+		assert.Error(t, err, "%v", types)
+		assert.Empty(t, listBucket(t, config.destStorageProvider, config.DestinationBucket), "%v", types)
+		tearDownMemory(config)
+	}
+}
+
+func TestFailedTransformKeepsExistingDestination(t *testing.T) {
+	setUp(1)
+	defer tearDown()
+	config := getPipelineConfig()
+	// The source is not a gzip.
+	config.Transforms = []TransformConfig{{Type: "Identity"}, {Type: "GzipDecompress"}}
+	assert.NoError(t, ioutil.WriteFile(dst_dir+"/0", []byte("previous output"), 0644))
+
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.Error(t, err)
+	b, err := ioutil.ReadFile(dst_dir + "/0")
+	assert.NoError(t, err)
+	assert.Equal(t, "previous output", string(b))
+	files, err := ioutil.ReadDir(dst_dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"io"
+	"time"
+)
+
+// The throughput of a worker assumed by the estimate of the run time, unless given.
+const cDefaultPlanBytesPerSecond = 10 << 20
+
+const (
+	cPlanNew     = "new"
+	cPlanResume  = "resume"
+	cPlanReplan  = "replan"
+	cPlanChanged = "changed"
+)
+
+// What a run of the pipeline would do, computed without writing anything.
+type Plan struct {
+	SourceBucket      string
+	DestinationBucket string
+	// "new" if the job has not started, "resume" if it continues from the manifest, "replan" if the source changed
+	// and a new manifest would be written and "changed" if the source changed and the run would fail.
+	Manifest         string
+	Objects          int
+	Bytes            int64
+	Batches          int
+	CompletedObjects int
+	CompletedBatches int
+	RemainingBytes   int64
+	Collisions       []NameCollision
+	// The estimate of the run time assumes every one of the Parallelism workers processes BytesPerSecond.
+	Parallelism      int
+	BytesPerSecond   int64
+	EstimatedSeconds float64
+	// Set if the source lists the objects without their size, e.g. http(s). The bytes and the estimate are then 0.
+	SizesUnknown bool
+	Warnings     []string
+}
+
+// Lists the source, resolves the destination names and reads the state to plan the run of the pipeline with the
+// given parallelism. The throughput of a worker is assumed to be bytesPerSecond, or a conservative default if 0.
+func PlanPipeline(ctx context.Context, config *PipelineConfig, parallelism int, bytesPerSecond int64) (*Plan, error) {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	if bytesPerSecond <= 0 {
+		bytesPerSecond = cDefaultPlanBytesPerSecond
+	}
+	plan := &Plan{SourceBucket: config.SourceBucket, DestinationBucket: config.DestinationBucket,
+		SizesUnknown: !storage.ListsObjectSizes(config.sourceStorageProvider), Parallelism: parallelism,
+		BytesPerSecond: bytesPerSecond}
+
+	current, err := listSource(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	persisted, err := readManifest(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	// The manifest the run would use, and which of its objects are already processed.
+	m := current
+	done := make([]bool, len(current.objects))
+	switch {
+	case persisted == nil:
+		plan.Manifest = cPlanNew
+	case persisted.fingerprint() == current.fingerprint():
+		plan.Manifest = cPlanResume
+		m = persisted
+		if done, err = processedObjects(ctx, config, persisted); err != nil {
+			return nil, err
+		}
+	default:
+		moved := false
+		if config.DeleteSourceOnSuccess {
+			if moved, err = onlyProcessedSourcesRemoved(ctx, config, persisted, current); err != nil {
+				return nil, err
+			}
+		}
+		if moved {
+			plan.Manifest = cPlanResume
+			m = persisted
+			if done, err = processedObjects(ctx, config, persisted); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if config.OnSourceChange != cSourceChangeReplan {
+			plan.Manifest = cPlanChanged
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("the source objects changed since the job started "+
+				"(%d objects then, %d now), the run would fail", len(persisted.objects), len(current.objects)))
+			break
+		}
+		plan.Manifest = cPlanReplan
+		old, err := processedObjects(ctx, config, persisted)
+		if err != nil {
+			return nil, err
+		}
+		processed := make(map[string]bool)
+		for i, o := range persisted.objects {
+			processed[o.Name] = old[i]
+		}
+		for i, o := range current.objects {
+			done[i] = processed[o.Name]
+		}
+	}
+
+	plan.Objects = len(m.objects)
+	for i, o := range m.objects {
+		plan.Bytes += o.Size
+		if done[i] {
+			plan.CompletedObjects++
+		} else {
+			plan.RemainingBytes += o.Size
+		}
+	}
+	batches := m.batches(config.BatchSize, config.BatchBytes)
+	plan.Batches = len(batches)
+	for b := range batches {
+		start, end := batchRange(batches, b, len(m.objects))
+		completed := true
+		for i := start; i < end; i++ {
+			completed = completed && done[i]
+		}
+		if completed {
+			plan.CompletedBatches++
+		}
+	}
+	names, err := destinationNames(config, m)
+	if err == nil {
+		plan.Collisions = findCollisions(m, names)
+		_, err = resolveDestinations(config, m)
+	}
+	if err != nil {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("the run would fail, %v", err))
+	} else if len(plan.Collisions) > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("%d destination objects are written by more than one "+
+			"source object, they are processed with OnNameCollision: \"%s\"", len(plan.Collisions), config.OnNameCollision))
+	}
+	plan.EstimatedSeconds = float64(plan.RemainingBytes) / float64(bytesPerSecond*int64(parallelism))
+	return plan, nil
+}
+
+// Returns which objects of the manifest are processed according to the state.
+func processedObjects(ctx context.Context, config *PipelineConfig, m *manifest) ([]bool, error) {
+	w, err := ReadMergedState(ctx, config, len(m.objects), m.fingerprint())
+	if err != nil {
+		return nil, err
+	}
+	done := make([]bool, len(m.objects))
+	for i := range done {
+		done[i] = w.m.isSet(i)
+	}
+	return done, nil
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Plan for %s -> %s (%s)\n", p.SourceBucket, p.DestinationBucket, p.Manifest)
+	if p.SizesUnknown {
+		fmt.Fprintf(w, "Objects: %d, size unknown (not listed by the source)\n", p.Objects)
+	} else {
+		fmt.Fprintf(w, "Objects: %d, %d bytes\n", p.Objects, p.Bytes)
+	}
+	fmt.Fprintf(w, "Completed: %d/%d batches, %d/%d objects\n", p.CompletedBatches, p.Batches, p.CompletedObjects,
+		p.Objects)
+	if p.SizesUnknown {
+		fmt.Fprintln(w, "Remaining: size unknown")
+		fmt.Fprintln(w, "Estimated run time: unknown")
+	} else {
+		fmt.Fprintf(w, "Remaining: %d bytes\n", p.RemainingBytes)
+		estimate := time.Duration(p.EstimatedSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "Estimated run time: %v with %d workers at %d bytes/s each\n", estimate, p.Parallelism,
+			p.BytesPerSecond)
+	}
+	for _, c := range p.Collisions {
+		fmt.Fprintf(w, "Collision: %s is written by %v\n", c.Destination, c.Sources)
+	}
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+}
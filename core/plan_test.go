@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlanNewJob(t *testing.T) {
+	config := setUpMemory(t, 2*cBatchSize)
+	defer tearDownMemory(config)
+
+	plan, err := PlanPipeline(context.Background(), config, 2, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, cPlanNew, plan.Manifest)
+	assert.Equal(t, 2*cBatchSize, plan.Objects)
+	assert.Equal(t, int64(2*cBatchSize*5), plan.Bytes)
+	assert.Equal(t, 2, plan.Batches)
+	assert.Equal(t, 0, plan.CompletedBatches)
+	assert.Equal(t, float64(cBatchSize), plan.EstimatedSeconds)
+	assert.Empty(t, plan.Warnings)
+	// Nothing is written.
+	assert.Empty(t, listBucket(t, config.stateStorageProvider, config.StateBucket))
+	assert.Empty(t, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+}
+
+func TestPlanResumedJob(t *testing.T) {
+	config := setUpMemory(t, 2*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+
+	plan, err := PlanPipeline(ctx, config, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, cPlanResume, plan.Manifest)
+	assert.Equal(t, 1, plan.CompletedBatches)
+	assert.Equal(t, cBatchSize, plan.CompletedObjects)
+	assert.Equal(t, int64(cBatchSize*5), plan.RemainingBytes)
+}
+
+func TestPlanChangedSource(t *testing.T) {
+	config := setUpMemory(t, cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	writer, err := storage.GetObjectWriter(ctx, config.sourceStorageProvider, config.SourceBucket, "new")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	plan, err := PlanPipeline(ctx, config, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, cPlanChanged, plan.Manifest)
+	assert.Equal(t, 1, len(plan.Warnings))
+
+	config.OnSourceChange = cSourceChangeReplan
+	plan, err = PlanPipeline(ctx, config, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, cPlanReplan, plan.Manifest)
+	assert.Equal(t, cBatchSize+1, plan.Objects)
+	assert.Equal(t, cBatchSize, plan.CompletedObjects)
+}
+
+func TestPlanReportsCollisions(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	for _, name := range []string{"a", "a.gz", "b.gz"} {
+		writer, err := storage.GetObjectWriter(ctx, config.sourceStorageProvider, config.SourceBucket, name)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+	}
+	config.StripSuffix = ".gz"
+
+	plan, err := PlanPipeline(ctx, config, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []NameCollision{{Destination: "a", Sources: []string{"a", "a.gz"}}}, plan.Collisions)
+
+	var out bytes.Buffer
+	assert.NoError(t, plan.WriteJSON(&out))
+	var decoded Plan
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, plan, &decoded)
+}
+
+func TestPlanWithUnknownSizes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "a\nb\n")
+	}))
+	defer server.Close()
+	config := &PipelineConfig{SourceBucket: server.URL + "/", DestinationBucket: "mem://plan_dst",
+		StateBucket: "mem://plan_state", Transforms: []TransformConfig{{Type: "Identity"}}}
+	config.StorageConfig.HttpConfig.Manifest = server.URL + "/manifest"
+	assert.NoError(t, config.InitReadOnly(context.Background()))
+	defer tearDownMemory(config)
+
+	plan, err := PlanPipeline(context.Background(), config, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, plan.Objects)
+	assert.True(t, plan.SizesUnknown)
+	var out bytes.Buffer
+	plan.Print(&out)
+	assert.Contains(t, out.String(), "size unknown")
+	assert.Contains(t, out.String(), "Estimated run time: unknown")
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const (
+	cDefaultMaxAttempts    = 3
+	cDefaultInitialBackoff = time.Second
+	cDefaultMaxBackoff     = 30 * time.Second
+
+	cPermanentFailureAbort = "abort"
+	cPermanentFailureSkip  = "skip"
+)
+
+// How the objects which fail are retried.
+type RetryConfig struct {
+	// The attempts per object including the first one, 3 by default. 1 disables the retries.
+	MaxAttempts int
+	// The wait before the first retry, e.g. "500ms", 1s by default. It doubles for every retry up to MaxBackoff (30s
+	// by default), with a random jitter of up to half of it.
+	InitialBackoff string
+	MaxBackoff     string
+	// What to do when an object fails with a permanent error (like a missing object or denied access), which is
+	// never retried: "abort" (default) the run, or "skip" the object and carry on.
+	OnPermanentFailure string
+}
+
+func parseDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (r *RetryConfig) validate() error {
+	if _, err := parseDuration(r.InitialBackoff, cDefaultInitialBackoff); err != nil {
+		return fmt.Errorf("invalid InitialBackoff %s, %v", r.InitialBackoff, err)
+	}
+	if _, err := parseDuration(r.MaxBackoff, cDefaultMaxBackoff); err != nil {
+		return fmt.Errorf("invalid MaxBackoff %s, %v", r.MaxBackoff, err)
+	}
+	return nil
+}
+
+func (r *RetryConfig) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return cDefaultMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+// Returns the wait before the retry following the given (1-based) attempt. The config is validated in Init.
+func (r *RetryConfig) backoff(attempt int) time.Duration {
+	initial, _ := parseDuration(r.InitialBackoff, cDefaultInitialBackoff)
+	max, _ := parseDuration(r.MaxBackoff, cDefaultMaxBackoff)
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// The jitter spreads the retries of the objects which failed together, e.g. when throttled.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// An error of reading the source or writing the destination object, as seen by the transforms. It tells the storage
+// errors apart from the ones of the transforms on the content, e.g. io.ErrUnexpectedEOF from a truncated gzip.
+type storageIOError struct {
+	err error
+}
+
+func (e *storageIOError) Error() string {
+	return e.err.Error()
+}
+
+func (e *storageIOError) Unwrap() error {
+	return e.err
+}
+
+type storageIOReader struct {
+	r io.Reader
+}
+
+func (r storageIOReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &storageIOError{err: err}
+	}
+	return n, err
+}
+
+type storageIOWriter struct {
+	w io.Writer
+}
+
+func (w storageIOWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		err = &storageIOError{err: err}
+	}
+	return n, err
+}
+
+// Returns true if the object can be processed when retried after the error. On top of the storage errors, corrupt
+// content fails the same way on every attempt: the transforms fail on it with decode and format errors, which are
+// not caused by reading the source or writing the destination.
+func isRetryable(err error) bool {
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt) {
+		return false
+	}
+	var tErr *transformError
+	var ioErr *storageIOError
+	if errors.As(err, &tErr) && !errors.As(err, &ioErr) {
+		return false
+	}
+	return storage.IsRetryable(err)
+}
+
+// Processes the object, retrying the transient failures with backoff. The result has the number of attempts made.
+func processObjectWithRetries(ctx context.Context, config *PipelineConfig, threadIdx int, object string, dstObjectName string) (objectResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := processObjectInPipeline(ctx, config, threadIdx, object, dstObjectName)
+		result.attempts = attempt
+		if err == nil || !isRetryable(err) || attempt >= config.Retry.maxAttempts() {
+			return result, err
+		}
+		wait := config.Retry.backoff(attempt)
+		log.Warnf("[Worker %d] Attempt %d of %d for %s failed, retrying in %v, %v", threadIdx, attempt,
+			config.Retry.maxAttempts(), object, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryConfig{InitialBackoff: "100ms", MaxBackoff: "1s"}
+	assert.NoError(t, r.validate())
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second} {
+		d := r.backoff(attempt + 1)
+		assert.True(t, d >= max/2 && d <= max, "attempt %d waits %v", attempt+1, d)
+	}
+	assert.Equal(t, cDefaultMaxAttempts, r.maxAttempts())
+	assert.Error(t, (&RetryConfig{MaxBackoff: "10"}).validate())
+}
+
+func TestTransientFailureIsRetried(t *testing.T) {
+	config := setUpMemory(t, cBatchSize)
+	defer tearDownMemory(config)
+	config.Retry = RetryConfig{MaxAttempts: 2, InitialBackoff: "1ms"}
+
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{FailReadN: 3})
+	c, err := RunPipeline(context.Background(), config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cBatchSize, c)
+	assert.Equal(t, cBatchSize, len(listBucket(t, config.destStorageProvider, config.DestinationBucket)))
+}
+
+func TestPermanentFailureIsNotRetried(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	// Would time out the test if retried.
+	config.Retry = RetryConfig{MaxAttempts: 5, InitialBackoff: "1h", MaxBackoff: "1h"}
+
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{DeleteDuringList: []string{"1"}})
+	_, err := RunPipeline(context.Background(), config, 0, false)
+	assert.Error(t, err)
+	assert.False(t, storage.IsRetryable(err))
+}
+
+func TestPermanentWriteFailureIsNotRetried(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	config.Retry = RetryConfig{MaxAttempts: 5, InitialBackoff: "1h", MaxBackoff: "1h"}
+
+	storage.SetMemoryFaults(config.DestinationBucket, storage.MemoryFaults{FailClose: map[string]error{"1": os.ErrPermission}})
+	dst, err := destinationNameOf(context.Background(), config, "1")
+	assert.NoError(t, err)
+	result, err := processObjectWithRetries(context.Background(), config, 0, "1", dst)
+	assert.True(t, errors.Is(err, os.ErrPermission))
+	assert.Equal(t, 1, result.attempts)
+}
+
+func TestCorruptContentIsNotRetried(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeTruncatedGzip(t, config)
+	config.Transforms = []TransformConfig{{Type: "GzipDecompress"}}
+	config.Retry = RetryConfig{MaxAttempts: 5, InitialBackoff: "1h", MaxBackoff: "1h"}
+
+	result, err := processObjectWithRetries(context.Background(), config, 0, "0", "0")
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Equal(t, 1, result.attempts)
+	// Unlike the storage errors the transforms see.
+	assert.True(t, isRetryable(&transformError{err: &storageIOError{err: io.ErrUnexpectedEOF}}))
+}
+
+func TestPermanentFailureIsSkipped(t *testing.T) {
+	config := setUpMemory(t, 3)
+	defer tearDownMemory(config)
+	config.Retry = RetryConfig{OnPermanentFailure: cPermanentFailureSkip}
+
+	storage.SetMemoryFaults(config.SourceBucket, storage.MemoryFaults{DeleteDuringList: []string{"1"}})
+	assert.NoError(t, RunPipelineLoop(context.Background(), config, 1, false))
+	assert.Equal(t, []string{"0", "2"}, listBucket(t, config.destStorageProvider, config.DestinationBucket))
+	copied, _, failed := config.run.counts()
+	assert.Equal(t, int64(2), copied)
+	assert.Equal(t, int64(1), failed)
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sharvanath/kromium/storage"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// Merges the worker state files of the current manifest into one file. Returns the number of files merged and the
+// name of the new file, which is empty if there was nothing to merge. It is safe to run while workers are running,
+// since the merged files are deleted only after the new one is written.
+func CompactState(ctx context.Context, pipeline *PipelineConfig) (int, string, error) {
+	m, err := readManifest(ctx, pipeline)
+	if err != nil || m == nil {
+		return 0, "", err
+	}
+	w, err := ReadMergedState(ctx, pipeline, len(m.objects), m.fingerprint())
+	if err != nil {
+		return 0, "", err
+	}
+	if len(w.mergedFiles) <= 1 {
+		return len(w.mergedFiles), "", nil
+	}
+	w.workerId = uuid.New().String()
+	if err := WriteState(ctx, pipeline.StateBucket, w); err != nil {
+		return 0, "", err
+	}
+	return len(w.mergedFiles), w.fileName(), nil
+}
+
+func deleteStateFiles(ctx context.Context, pipeline *PipelineConfig, files []string) error {
+	for _, f := range files {
+		if err := storage.DeleteObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, f); err != nil {
+			return fmt.Errorf("failed to delete %s, %v", f, err)
+		}
+		log.Infof("Deleted %s", f)
+	}
+	return nil
+}
+
+// Deletes the progress of the current config, i.e. the worker state files, the manifest, the leases and the
+// dead-letter log, so that the next run starts from scratch. The audit files and the config record are kept. With
+// dryRun the files are only returned. The workers of the config must not be running.
+func ResetState(ctx context.Context, pipeline *PipelineConfig, dryRun bool) ([]string, error) {
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, pipeline.getHash(), "/")
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, f := range files {
+		hash, kind := parseStateFileName(f)
+		if hash != pipeline.getHash() || kind == "audit" || kind == "config" {
+			continue
+		}
+		deleted = append(deleted, f)
+	}
+	sort.Strings(deleted)
+	if dryRun {
+		return deleted, nil
+	}
+	return deleted, deleteStateFiles(ctx, pipeline, deleted)
+}
+
+// Deletes the files in the state bucket written by the configs other than the given ones, e.g. the earlier versions
+// of a pipeline. All the configs must share the state bucket, which must not be the source or destination bucket of
+// any of them since their objects could be taken for state files. The files not written by Kromium are kept. With
+// dryRun the files are only returned.
+func GarbageCollectState(ctx context.Context, pipelines []*PipelineConfig, dryRun bool) ([]string, error) {
+	if len(pipelines) == 0 {
+		return nil, fmt.Errorf("at least one config is needed")
+	}
+	live := make(map[string]bool)
+	for _, p := range pipelines {
+		if p.StateBucket != pipelines[0].StateBucket {
+			return nil, fmt.Errorf("the configs have different state buckets %s and %s", pipelines[0].StateBucket,
+				p.StateBucket)
+		}
+		if p.StateBucket == p.SourceBucket || p.StateBucket == p.DestinationBucket {
+			return nil, fmt.Errorf("refusing to collect the state bucket %s, it is also the source or destination "+
+				"bucket of the config", p.StateBucket)
+		}
+		live[p.getHash()] = true
+	}
+	files, err := storage.ListObjects(ctx, pipelines[0].stateStorageProvider, pipelines[0].StateBucket, "", "/")
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, f := range files {
+		if hash, _ := parseStateFileName(f); hash != "" && !live[hash] {
+			deleted = append(deleted, f)
+		}
+	}
+	sort.Strings(deleted)
+	if dryRun {
+		return deleted, nil
+	}
+	return deleted, deleteStateFiles(ctx, pipelines[0], deleted)
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Runs the pipeline on every batch with a worker of its own, so that every batch leaves a state file.
+func runBatchesSeparately(t *testing.T, config *PipelineConfig, batches int) {
+	for i := 0; i < batches; i++ {
+		_, err := RunPipeline(context.Background(), config, i, false)
+		assert.NoError(t, err)
+	}
+}
+
+func TestInspectStateProgress(t *testing.T) {
+	config := setUpMemory(t, 3*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+
+	report, err := InspectState(ctx, config)
+	assert.NoError(t, err)
+	assert.Nil(t, report.Progress)
+
+	runBatchesSeparately(t, config, 2)
+	report, err = InspectState(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*cBatchSize, report.Progress.Objects)
+	assert.Equal(t, 2*cBatchSize, report.Progress.Processed)
+	assert.Equal(t, 3, report.Progress.Batches)
+	assert.Equal(t, 2, report.Progress.ProcessedBatches)
+}
+
+func TestCompactState(t *testing.T) {
+	config := setUpMemory(t, 3*cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	runBatchesSeparately(t, config, 3)
+	// Every run merges the state files of the earlier ones, so add one more.
+	m, err := config.getManifest(ctx)
+	assert.NoError(t, err)
+	w := createState(config, len(m.objects), m.fingerprint())
+	w.workerId = uuid.New().String()
+	w.setProcessed(0)
+	assert.NoError(t, WriteState(ctx, config.StateBucket, w))
+
+	merged, file, err := CompactState(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, merged)
+	assert.NotEmpty(t, file)
+
+	report, err := InspectState(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{file}, report.Progress.MergedFiles)
+	assert.Equal(t, 3*cBatchSize, report.Progress.Processed)
+
+	merged, file, err = CompactState(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, merged)
+	assert.Empty(t, file)
+}
+
+func TestResetState(t *testing.T) {
+	config := setUpMemory(t, cBatchSize)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Verify = true
+	runBatchesSeparately(t, config, 1)
+
+	files, err := ResetState(ctx, config, true)
+	assert.NoError(t, err)
+	// The manifest and the state file.
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, 4, len(listBucket(t, config.stateStorageProvider, config.StateBucket)))
+
+	_, err = ResetState(ctx, config, false)
+	assert.NoError(t, err)
+	for _, f := range listBucket(t, config.stateStorageProvider, config.StateBucket) {
+		_, kind := parseStateFileName(f)
+		assert.Contains(t, []string{"audit", "config"}, kind)
+	}
+	c, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cBatchSize, c)
+}
+
+func TestGarbageCollectState(t *testing.T) {
+	config := setUpMemory(t, 2)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	runBatchesSeparately(t, config, 1)
+
+	old := *config
+	old.StripSuffix = ".old"
+	assert.NoError(t, old.Init(ctx))
+	writeTestState(t, &old, 2, 0)
+	unknown := "notes.txt"
+	writer, err := storage.GetObjectWriter(ctx, config.stateStorageProvider, config.StateBucket, unknown)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	files, err := GarbageCollectState(ctx, []*PipelineConfig{config}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	remaining := listBucket(t, config.stateStorageProvider, config.StateBucket)
+	assert.Contains(t, remaining, unknown)
+	assert.NotContains(t, remaining, files[0])
+
+	// The state of every given config is kept.
+	files, err = GarbageCollectState(ctx, []*PipelineConfig{config, &old}, true)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestGarbageCollectStateRefusesSharedBucket(t *testing.T) {
+	config := setUpMemory(t, 1)
+	defer tearDownMemory(config)
+	shared := *config
+	shared.StateBucket = shared.DestinationBucket
+	_, err := GarbageCollectState(context.Background(), []*PipelineConfig{&shared}, true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// The state files start with the magic bytes and the version of the format. The ones written before the format was
+// versioned (version 0) are gob encoded and have no magic bytes.
+const (
+	cStateMagic   = "KRST"
+	cStateVersion = 1
+)
+
+// The content of a state file. The format of version 1 is, with big-endian integers:
+//
+//	magic "KRST" | version uint16 | pipeline hash | fingerprint | started int64 | written int64 | granularity uvarint |
+//	bitmap size uvarint | deflated bitmap | CRC32C uint32
+//
+// The strings and the deflated bitmap are prefixed with their uvarint length, the times are unix nanoseconds and the
+// CRC32C covers all the preceding bytes.
+type stateFile struct {
+	version int
+	// The hash of the pipeline which wrote the file, empty for version 0.
+	hash string
+	// The fingerprint of the manifest the bits refer to, empty for the files written before the manifest.
+	fingerprint string
+	// When the worker started and when it wrote the file, zero for version 0.
+	started time.Time
+	written time.Time
+	// The number of objects per bit.
+	granularity int
+	m           *bitmap
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], uint64(len(s)))])
+	buf.WriteString(s)
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (s *stateFile) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(cStateMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(cStateVersion))
+	putString(&buf, s.hash)
+	putString(&buf, s.fingerprint)
+	binary.Write(&buf, binary.BigEndian, s.started.UnixNano())
+	binary.Write(&buf, binary.BigEndian, s.written.UnixNano())
+	putUvarint(&buf, uint64(s.granularity))
+	putUvarint(&buf, uint64(s.m.size))
+
+	// The bitmaps are mostly runs of ones or zeros, which deflate well.
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(s.m.slice)
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	putUvarint(&buf, uint64(deflated.Len()))
+	buf.Write(deflated.Bytes())
+
+	binary.Write(&buf, binary.BigEndian, crc32.Checksum(buf.Bytes(), crc32cTable))
+	return buf.Bytes(), nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func readTime(r *bytes.Reader) (time.Time, error) {
+	var nanos int64
+	if err := binary.Read(r, binary.BigEndian, &nanos); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// Decodes a state file of any version.
+func decodeStateFile(reader io.Reader) (*stateFile, error) {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(cStateMagic)) {
+		return decodeLegacyStateFile(b)
+	}
+	if len(b) < len(cStateMagic)+2+4 {
+		return nil, fmt.Errorf("truncated state file of %d bytes", len(b))
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crc32cTable) != sum {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	r := bytes.NewReader(body[len(cStateMagic):])
+	var version uint16
+	binary.Read(r, binary.BigEndian, &version)
+	if version > cStateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d, it was written by a newer version", version)
+	}
+	s := &stateFile{version: int(version)}
+	if s.hash, err = readString(r); err != nil {
+		return nil, err
+	}
+	if s.fingerprint, err = readString(r); err != nil {
+		return nil, err
+	}
+	if s.started, err = readTime(r); err != nil {
+		return nil, err
+	}
+	if s.written, err = readTime(r); err != nil {
+		return nil, err
+	}
+	granularity, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	deflated, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes at the end of the state file", r.Len())
+	}
+	want := size / 8
+	if size%8 != 0 {
+		want++
+	}
+	// The bitmap is inflated at most one byte past its size, so that a corrupt or crafted file cannot inflate to more.
+	slice, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader([]byte(deflated))), int64(want)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(slice)) != want {
+		return nil, fmt.Errorf("inconsistent bitmap of %d bytes for %d bits", len(slice), size)
+	}
+	s.granularity = int(granularity)
+	s.m = &bitmap{slice: slice, size: int(size)}
+	return s, nil
+}
+
+// Decodes the gob encoded bitmap of the files written before the format was versioned, with a bit per batch of
+// cBatchSize objects.
+func decodeLegacyStateFile(b []byte) (*stateFile, error) {
+	r := bytes.NewReader(b)
+	m, err := decodeBitmap(gob.NewDecoder(r))
+	if err != nil {
+		return nil, err
+	}
+	if len(m.slice) != (m.size+7)/8 {
+		return nil, fmt.Errorf("inconsistent bitmap of %d bytes for %d bits", len(m.slice), m.size)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after the bitmap", r.Len())
+	}
+	return &stateFile{m: m, granularity: cBatchSize}, nil
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func testStateFile() *stateFile {
+	m := newBitmap(100)
+	for _, i := range []int{0, 1, 2, 50, 99} {
+		m.set(i)
+	}
+	return &stateFile{version: cStateVersion, hash: "hash", fingerprint: "fingerprint", started: time.Unix(100, 1).UTC(),
+		written: time.Unix(200, 2).UTC(), granularity: cObjectGranularity, m: m}
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	s := testStateFile()
+	b, err := s.encode()
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(b, []byte(cStateMagic)))
+
+	decoded, err := decodeStateFile(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, s, decoded)
+}
+
+func TestCorruptStateFileIsRejected(t *testing.T) {
+	b, err := testStateFile().encode()
+	assert.NoError(t, err)
+
+	flipped := append([]byte{}, b...)
+	flipped[len(cStateMagic)+4] ^= 1
+	_, err = decodeStateFile(bytes.NewReader(flipped))
+	assert.Error(t, err)
+	_, err = decodeStateFile(bytes.NewReader(b[:len(b)-1]))
+	assert.Error(t, err)
+	_, err = decodeStateFile(bytes.NewReader(b[:len(cStateMagic)+1]))
+	assert.Error(t, err)
+}
+
+func TestOversizedBitmapIsRejected(t *testing.T) {
+	// A megabyte of zeros deflates to about a kilobyte, for a bitmap of only 100 bits.
+	s := testStateFile()
+	s.m = &bitmap{slice: make([]byte, 1<<20), size: 100}
+	b, err := s.encode()
+	assert.NoError(t, err)
+	_, err = decodeStateFile(bytes.NewReader(b))
+	assert.Error(t, err)
+
+	s.m = &bitmap{slice: make([]byte, 12), size: 100}
+	b, err = s.encode()
+	assert.NoError(t, err)
+	_, err = decodeStateFile(bytes.NewReader(b))
+	assert.Error(t, err)
+}
+
+func TestNewerStateFileVersionIsRejected(t *testing.T) {
+	b, err := testStateFile().encode()
+	assert.NoError(t, err)
+	binary.BigEndian.PutUint16(b[len(cStateMagic):], cStateVersion+1)
+	body := b[:len(b)-4]
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(body, crc32cTable))
+
+	_, err = decodeStateFile(bytes.NewReader(b))
+	assert.Error(t, err)
+}
+
+func TestLegacyStateFileIsDecoded(t *testing.T) {
+	m := newBitmap(10)
+	m.set(3)
+	var buf bytes.Buffer
+	assert.NoError(t, m.writeTo(&buf))
+	legacy := buf.Bytes()
+
+	s, err := decodeStateFile(bytes.NewReader(legacy))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.version)
+	assert.Equal(t, "", s.fingerprint)
+	assert.Equal(t, cBatchSize, s.granularity)
+	assert.True(t, s.m.isSet(3))
+
+	assert.NoError(t, gob.NewEncoder(&buf).Encode("fingerprint"))
+	_, err = decodeStateFile(&buf)
+	assert.Error(t, err)
+}
+
+func TestCorruptStateFileIsSkippedWhenMerged(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	writeTestState(t, config, 4*cBatchSize, 0)
+	corrupt := writeTestState(t, config, 4*cBatchSize, 2)
+
+	storage.SetMemoryFaults(config.StateBucket, storage.MemoryFaults{Truncate: map[string]int{corrupt.fileName(): 10}})
+	w, err := ReadMergedState(ctx, config, 4*cBatchSize, "fingerprint")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{corrupt.fileName()}, w.corruptFiles)
+	assert.True(t, w.m.isSet(0))
+	assert.False(t, w.m.isSet(2))
+
+	// The corrupt file is not deleted when the merged state is written.
+	w.workerId = "merged"
+	assert.NoError(t, WriteState(ctx, config.StateBucket, w))
+	assert.Contains(t, listBucket(t, config.stateStorageProvider, config.StateBucket), corrupt.fileName())
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cHashLength = 40
+
+	cRelationCurrent = "current"
+	cRelationLegacy  = "legacy"
+)
+
+// A state file of a worker, as found in the state bucket.
+type StateFileInfo struct {
+	Name        string
+	Version     int
+	Fingerprint string
+	Written     time.Time
+	// The number of objects marked as processed, of Objects.
+	Processed int
+	Objects   int
+	// Set if the file could not be decoded.
+	Err error
+}
+
+// The files in the state bucket written by one version of a pipeline config, i.e. with the same hash.
+type StateGroup struct {
+	Hash string
+	// "current" for the files of the given config, "legacy" for the ones it wrote before the hash covered the
+	// transform args, empty for the other configs.
+	Relation string
+	// The config which wrote the files, nil if it was not recorded.
+	Config     *configRecord
+	StateFiles []StateFileInfo
+	// The number of the other files of the group by kind, e.g. "manifest", "audit" or "lease".
+	Files map[string]int
+}
+
+// The progress of the current config, merged from all the worker state files.
+type StateProgress struct {
+	Objects          int
+	Processed        int
+	Batches          int
+	ProcessedBatches int
+	// The worker state files merged into the progress, and the ones skipped since they could not be decoded.
+	MergedFiles  []string
+	CorruptFiles []string
+}
+
+type StateReport struct {
+	Bucket string
+	// Nil if the job has not started, i.e. the manifest is not written yet.
+	Progress *StateProgress
+	Groups   []*StateGroup
+	// The files which do not belong to any pipeline.
+	Unknown []string
+}
+
+// Returns the hash of the pipeline which wrote the file and the kind of the file, "state" for the worker state
+// files. The hash is empty if the file was not written by Kromium.
+func parseStateFileName(name string) (string, string) {
+	if len(name) <= cHashLength || (name[cHashLength] != '_' && name[cHashLength] != '.') {
+		return "", ""
+	}
+	hash := name[:cHashLength]
+	if strings.Trim(hash, "0123456789abcdef") != "" {
+		return "", ""
+	}
+	if name[cHashLength] == '_' {
+		return hash, "state"
+	}
+	kind := name[cHashLength+1:]
+	if i := strings.IndexByte(kind, '_'); i >= 0 {
+		kind = kind[:i]
+	}
+	return hash, kind
+}
+
+func readConfigRecord(ctx context.Context, pipeline *PipelineConfig, name string) (*configRecord, error) {
+	reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var r configRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func readStateFileInfo(ctx context.Context, pipeline *PipelineConfig, name string) StateFileInfo {
+	info := StateFileInfo{Name: name}
+	reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, name)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	defer reader.Close()
+	s, err := decodeStateFile(reader)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	info.Version = s.version
+	info.Fingerprint = s.fingerprint
+	info.Written = s.written
+	info.Processed = s.m.usedSize() * s.granularity
+	info.Objects = s.m.size * s.granularity
+	return info
+}
+
+// Merges the state of the current manifest. Returns nil if the manifest is not written yet.
+func readProgress(ctx context.Context, pipeline *PipelineConfig) (*StateProgress, error) {
+	m, err := readManifest(ctx, pipeline)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	w, err := ReadMergedState(ctx, pipeline, len(m.objects), m.fingerprint())
+	if err != nil {
+		return nil, err
+	}
+	batches := m.batches(pipeline.BatchSize, pipeline.BatchBytes)
+	return &StateProgress{
+		Objects:          len(m.objects),
+		Processed:        w.m.usedSize(),
+		Batches:          len(batches),
+		ProcessedBatches: len(batches) - len(w.pendingBatches(batches)),
+		MergedFiles:      w.mergedFiles,
+		CorruptFiles:     w.corruptFiles,
+	}, nil
+}
+
+// Lists the files in the state bucket of the pipeline, grouped by the version of the config which wrote them, and
+// the progress of the current config.
+func InspectState(ctx context.Context, pipeline *PipelineConfig) (*StateReport, error) {
+	progress, err := readProgress(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, "", "/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	report := &StateReport{Bucket: pipeline.StateBucket, Progress: progress}
+	groups := make(map[string]*StateGroup)
+	for _, f := range files {
+		hash, kind := parseStateFileName(f)
+		if hash == "" {
+			report.Unknown = append(report.Unknown, f)
+			continue
+		}
+		g, ok := groups[hash]
+		if !ok {
+			g = &StateGroup{Hash: hash, Files: make(map[string]int)}
+			switch hash {
+			case pipeline.getHash():
+				g.Relation = cRelationCurrent
+			case pipeline.legacyHash():
+				g.Relation = cRelationLegacy
+			}
+			groups[hash] = g
+			report.Groups = append(report.Groups, g)
+		}
+		switch kind {
+		case "state":
+			g.StateFiles = append(g.StateFiles, readStateFileInfo(ctx, pipeline, f))
+		case "config":
+			if g.Config, err = readConfigRecord(ctx, pipeline, f); err != nil {
+				return nil, fmt.Errorf("failed to read the config record %s, %v", f, err)
+			}
+			g.Files[kind]++
+		default:
+			g.Files[kind]++
+		}
+	}
+	// The current config first.
+	sort.SliceStable(report.Groups, func(i, j int) bool {
+		return report.Groups[i].Relation == cRelationCurrent && report.Groups[j].Relation != cRelationCurrent
+	})
+	return report, nil
+}
+
+func (r *configRecord) describe() string {
+	var stages []string
+	for _, t := range r.Transforms {
+		stages = append(stages, fmt.Sprintf("%s(args %.8s)", t.Type, t.ArgsHash))
+	}
+	names := fmt.Sprintf("name suffix %q, strip suffix %q", r.NameSuffix, r.StripSuffix)
+	if r.DestinationKey != "" {
+		names = fmt.Sprintf("destination key %q", r.DestinationKey)
+	}
+	return fmt.Sprintf("%s%s -> %s, %s, transforms [%s]", r.SourceBucket, r.SourcePrefix, r.DestinationBucket, names,
+		strings.Join(stages, ", "))
+}
+
+func (r *StateReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "State bucket %s\n", r.Bucket)
+	if p := r.Progress; p != nil {
+		fmt.Fprintf(w, "Processed %d/%d batches, %d/%d objects, merged from %d state files\n", p.ProcessedBatches,
+			p.Batches, p.Processed, p.Objects, len(p.MergedFiles))
+		for _, f := range p.MergedFiles {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+		for _, f := range p.CorruptFiles {
+			fmt.Fprintf(w, "  %s (corrupt, skipped)\n", f)
+		}
+	} else {
+		fmt.Fprintln(w, "The job has not started")
+	}
+	for _, g := range r.Groups {
+		fmt.Fprintf(w, "\nConfig %s", g.Hash)
+		if g.Relation != "" {
+			fmt.Fprintf(w, " (%s)", g.Relation)
+		}
+		fmt.Fprintln(w)
+		switch {
+		case g.Config != nil:
+			fmt.Fprintf(w, "  %s\n", g.Config.describe())
+		case g.Relation == cRelationLegacy:
+			fmt.Fprintln(w, "  written before the hash covered the transform args, it is resumed only by the configs "+
+				"without transform args and naming options")
+		default:
+			fmt.Fprintln(w, "  config not recorded")
+		}
+		var kinds []string
+		for k := range g.Files {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			fmt.Fprintf(w, "  %d %s files\n", g.Files[k], k)
+		}
+		for _, s := range g.StateFiles {
+			if s.Err != nil {
+				fmt.Fprintf(w, "  %s: corrupt, %v\n", s.Name, s.Err)
+				continue
+			}
+			written := "unknown"
+			if !s.Written.IsZero() {
+				written = s.Written.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  %s: version %d, written %s, %d/%d objects processed\n", s.Name, s.Version, written,
+				s.Processed, s.Objects)
+		}
+	}
+	if len(r.Unknown) > 0 {
+		fmt.Fprintf(w, "\n%d files not written by Kromium\n", len(r.Unknown))
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/sharvanath/kromium/storage"
+	"strings"
+)
+
+const (
+	cModeCopy = "copy"
+	cModeSync = "sync"
+)
+
+// Returns true if the transforms leave the content unchanged, so that the source and destination objects can be
+// compared by content.
+func (p *PipelineConfig) isIdentity() bool {
+	for _, t := range p.Transforms {
+		if t.Type != "Identity" {
+			return false
+		}
+	}
+	return true
+}
+
+func getScheme(bucket string) string {
+	if i := strings.Index(bucket, "://"); i >= 0 {
+		return bucket[:i]
+	}
+	return bucket
+}
+
+// Returns true if the destination object is up to date with the source object, so that it need not be written again.
+// When the content is copied as is, the MD5s are compared if both are known, and otherwise the sizes and the ETags
+// (which are only comparable within the same provider). Failing that, and always when the content is transformed,
+// the destination is current if it was written after the last change to the source.
+func isDestinationCurrent(src *storage.ObjectAttrs, dst *storage.ObjectAttrs, sameContent bool, sameProvider bool) bool {
+	if sameContent {
+		if src.MD5 != "" && dst.MD5 != "" {
+			return src.MD5 == dst.MD5
+		}
+		if src.Size != dst.Size {
+			return false
+		}
+		if sameProvider && src.ETag != "" && src.ETag == dst.ETag {
+			return true
+		}
+	}
+	return !src.ModTime.IsZero() && !dst.ModTime.Before(src.ModTime)
+}
+
+// Returns true if the destination object of the source object is up to date. With DeleteSourceOnSuccess the source is
+// deleted after the skip, so the destination must have the same content, i.e. the same MD5 with Identity transforms.
+// The others are written and verified again.
+func isObjectSynced(ctx context.Context, config *PipelineConfig, src *storage.ObjectAttrs, dstObjectName string) (bool, error) {
+	dst, err := storage.StatObject(ctx, config.destStorageProvider, config.DestinationBucket, dstObjectName)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if config.DeleteSourceOnSuccess {
+		return config.isIdentity() && src.MD5 != "" && src.MD5 == dst.MD5, nil
+	}
+	sameProvider := getScheme(config.SourceBucket) == getScheme(config.DestinationBucket)
+	return isDestinationCurrent(src, dst, config.isIdentity(), sameProvider), nil
+}
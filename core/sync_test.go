@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/sharvanath/kromium/storage"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestIsDestinationCurrent(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	for i, c := range []struct {
+		src          storage.ObjectAttrs
+		dst          storage.ObjectAttrs
+		sameContent  bool
+		sameProvider bool
+		current      bool
+	}{
+		{storage.ObjectAttrs{MD5: "a", ModTime: older}, storage.ObjectAttrs{MD5: "a"}, true, false, true},
+		{storage.ObjectAttrs{MD5: "a"}, storage.ObjectAttrs{MD5: "b", ModTime: newer}, true, false, false},
+		{storage.ObjectAttrs{Size: 1, ModTime: older}, storage.ObjectAttrs{Size: 2, ModTime: newer}, true, false, false},
+		{storage.ObjectAttrs{Size: 1, ETag: "x", ModTime: newer}, storage.ObjectAttrs{Size: 1, ETag: "x", ModTime: older}, true, true, true},
+		// The ETags of different providers are not comparable.
+		{storage.ObjectAttrs{Size: 1, ETag: "x", ModTime: newer}, storage.ObjectAttrs{Size: 1, ETag: "x", ModTime: older}, true, false, false},
+		{storage.ObjectAttrs{Size: 1, ModTime: older}, storage.ObjectAttrs{Size: 1, ModTime: older}, true, false, true},
+		// The content and so the sizes differ when transformed.
+		{storage.ObjectAttrs{Size: 1, MD5: "a", ModTime: older}, storage.ObjectAttrs{Size: 2, MD5: "b", ModTime: newer}, false, false, true},
+		{storage.ObjectAttrs{Size: 1, ModTime: newer}, storage.ObjectAttrs{Size: 2, ModTime: older}, false, false, false},
+		{storage.ObjectAttrs{}, storage.ObjectAttrs{ModTime: newer}, false, false, false},
+	} {
+		assert.Equal(t, c.current, isDestinationCurrent(&c.src, &c.dst, c.sameContent, c.sameProvider), "case %d", i)
+	}
+}
+
+func TestSyncSkipsUpToDateObjects(t *testing.T) {
+	config := setUpMemory(t, 10)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Mode = cModeSync
+	for i, content := range []string{"test\n", "test\n", "stale\n"} {
+		w, err := storage.GetObjectWriter(ctx, config.destStorageProvider, config.DestinationBucket, fmt.Sprintf("%d", i))
+		assert.NoError(t, err)
+		w.Write([]byte(content))
+		assert.NoError(t, w.Close())
+	}
+
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	copied, skipped, _ := config.run.counts()
+	assert.Equal(t, int64(8), copied)
+	assert.Equal(t, int64(2), skipped)
+	r, err := storage.GetObjectReader(ctx, config.destStorageProvider, config.DestinationBucket, "2")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "test\n", string(b))
+
+	// A new pipeline (with a fresh state) against the same buckets copies nothing.
+	storage.ResetMemoryBucket(config.StateBucket)
+	config.run = &pipelineRun{}
+	_, err = RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	copied, skipped, _ = config.run.counts()
+	assert.Equal(t, int64(0), copied)
+	assert.Equal(t, int64(10), skipped)
+}
+
+func TestSyncComparesTimesWhenTransformed(t *testing.T) {
+	config := setUpMemory(t, 1)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Mode = cModeSync
+	config.Transforms = []TransformConfig{{Type: "GzipCompress", Args: map[string]interface{}{}}}
+
+	_, err := RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	storage.ResetMemoryBucket(config.StateBucket)
+	config.run = &pipelineRun{}
+	_, err = RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	copied, skipped, _ := config.run.counts()
+	assert.Equal(t, int64(0), copied)
+	assert.Equal(t, int64(1), skipped)
+
+	// The source changed after the destination was written.
+	w, err := storage.GetObjectWriterWithAttrs(ctx, config.sourceStorageProvider, config.SourceBucket, "0",
+		&storage.ObjectAttrs{ModTime: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	w.Write([]byte("changed\n"))
+	assert.NoError(t, w.Close())
+	storage.ResetMemoryBucket(config.StateBucket)
+	config.run = &pipelineRun{}
+	_, err = RunPipeline(ctx, config, 0, false)
+	assert.NoError(t, err)
+	copied, _, _ = config.run.counts()
+	assert.Equal(t, int64(1), copied)
+}
+
+func TestSyncRewritesTransformedObjectsBeforeDeletingTheSource(t *testing.T) {
+	config := setUpMemory(t, 1)
+	defer tearDownMemory(config)
+	ctx := context.Background()
+	config.Mode = cModeSync
+	config.DeleteSourceOnSuccess = true
+	config.Transforms = []TransformConfig{{Type: "GzipCompress", Args: map[string]interface{}{}}}
+	// Newer than the source, but not what the transform writes.
+	w, err := storage.GetObjectWriterWithAttrs(ctx, config.destStorageProvider, config.DestinationBucket, "0",
+		&storage.ObjectAttrs{ModTime: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	w.Write([]byte("stale\n"))
+	assert.NoError(t, w.Close())
+
+	assert.NoError(t, RunPipelineLoop(ctx, config, 1, false))
+	copied, skipped, _ := config.run.counts()
+	assert.Equal(t, int64(1), copied)
+	assert.Equal(t, int64(0), skipped)
+	assert.Empty(t, listBucket(t, config.sourceStorageProvider, config.SourceBucket))
+	r, err := storage.GetObjectReader(ctx, config.destStorageProvider, config.DestinationBucket, "0")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, gzipBytes(t, "test\n")[:2], b[:2])
+}
@@ -2,39 +2,48 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"github.com/sharvanath/kromium/storage"
 	log "github.com/sirupsen/logrus"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 )
 
-// The batch size
+// The default number of objects in a batch. It was also the granularity of the state files written before the objects
+// were tracked one by one.
 const cBatchSize = 16
 
-// Only the byte slice is serialized to the state file. workerId is used for the state file name.
+// The granularity of the bitmaps written to the state files now, one bit per object.
+const cObjectGranularity = 1
+
+// Only the byte slice and the listing fingerprint are serialized to the state file. workerId is used for the state
+// file name.
 type WorkerState struct {
-	// One bit for each batch. If the bit is 1 that means the batch has been processed already.
+	// One bit for each object of the manifest. If the bit is 1 that means the object has been processed already.
 	m *bitmap
+	// The fingerprint of the manifest the object indexes refer to.
+	fingerprint string
 	// The following is just in-memory state
+	started       time.Time
 	numFiles      int
 	processed     int
 	workerId      string
 	mergedFiles   []string
+	// The state files which could not be decoded, or were written by a different pipeline.
+	corruptFiles  []string
 	pipeline      *PipelineConfig
 }
 
-func createState(pipeline *PipelineConfig, numFiles int) *WorkerState {
+func createState(pipeline *PipelineConfig, numFiles int, fingerprint string) *WorkerState {
 	var w WorkerState
-	// Add an extra partial batch in case numFile is not perfectly divisible.
-	b_size := numFiles / cBatchSize
-	if numFiles%cBatchSize != 0 {
-		b_size += 1
-	}
-
 	w.pipeline = pipeline
+	w.started = time.Now()
 	w.numFiles = numFiles
-	w.m = newBitmap(b_size)
+	w.fingerprint = fingerprint
+	w.m = newBitmap(numFiles)
 	return &w
 }
 
@@ -51,35 +60,116 @@ func (w *WorkerState) fileName() string {
 	return w.pipeline.getHash() + "_" + sha1Str(w.workerId)
 }
 
-// Process files [start, end)
-func (w *WorkerState) findProcessingRange() (int, int) {
+// Returns the range [start, end) of the batch with the given index. The batches are given by their start indexes.
+func batchRange(batches []int, batch int, numFiles int) (int, int) {
+	end := numFiles
+	if batch+1 < len(batches) {
+		end = batches[batch+1]
+	}
+	return batches[batch], end
+}
+
+// Process files [start, end) of a batch with at least one object not processed yet.
+func (w *WorkerState) findProcessingRange(batches []int) (int, int) {
 	idx := w.m.findRandomEmpty()
 	if idx == -1 {
 		return -1, -1
 	}
-	end := idx*cBatchSize + cBatchSize
-	if end > w.numFiles {
-		end = w.numFiles
+	return batchRange(batches, sort.SearchInts(batches, idx+1)-1, w.numFiles)
+}
+
+// Returns true if any of the objects [start, end) is not processed yet.
+func (w *WorkerState) hasPending(start int, end int) bool {
+	for i := start; i < end; i++ {
+		if !w.m.isSet(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the indexes of the batches with objects not processed yet.
+func (w *WorkerState) pendingBatches(batches []int) []int {
+	var pending []int
+	for i := range batches {
+		if w.hasPending(batchRange(batches, i, w.numFiles)) {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+func (w *WorkerState) setProcessed(idx int) {
+	w.m.set(idx)
+}
+
+func (w *WorkerState) writeTo(writer io.Writer) error {
+	s := stateFile{
+		version:     cStateVersion,
+		hash:        w.pipeline.getHash(),
+		fingerprint: w.fingerprint,
+		started:     w.started,
+		written:     time.Now(),
+		granularity: cObjectGranularity,
+		m:           w.m,
+	}
+	b, err := s.encode()
+	if err != nil {
+		return err
 	}
-	return idx * cBatchSize, end
+	_, err = writer.Write(b)
+	return err
 }
 
-func (w *WorkerState) setProcessed(startOff int) {
-	batchIdx := startOff / cBatchSize
-	w.m.set(batchIdx)
+// Expands a bitmap with a bit per batch of objects to one with a bit per object.
+func expandBitmap(m *bitmap, granularity int, numFiles int) (*bitmap, error) {
+	if granularity == cObjectGranularity {
+		return m, nil
+	}
+	if granularity <= 0 || m.size != (numFiles+granularity-1)/granularity {
+		return nil, fmt.Errorf("inconsistent bitmap length %d for %d objects in batches of %d", m.size, numFiles, granularity)
+	}
+	expanded := newBitmap(numFiles)
+	for i := 0; i < numFiles; i++ {
+		if m.isSet(i / granularity) {
+			expanded.set(i)
+		}
+	}
+	return expanded, nil
 }
 
+// The number of times the state files are listed again when some of them were deleted after they were listed.
+const cMaxStateReads = 3
+
 type WorkerStateResp struct {
 	w *WorkerState
 	e error
+	// The file was deleted after it was listed.
+	deleted bool
+	corrupt bool
 }
-func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int) (*WorkerState, error) {
-	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket)
+
+// Merges the state files written for the manifest with the given fingerprint. The state files written for a different
+// listing of the source are ignored since their object indexes point at different objects.
+func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int, fingerprint string) (*WorkerState, error) {
+	for attempt := 1; ; attempt++ {
+		w, deleted, err := readMergedStateOnce(ctx, pipeline, numFiles, fingerprint)
+		// A worker deletes the files it merged only after writing its own, so listing again finds the bits they had.
+		if err != nil || !deleted || attempt >= cMaxStateReads {
+			return w, err
+		}
+		log.Debugf("State files were deleted while they were merged, reading the state again")
+	}
+}
+
+// Returns true if any of the listed files was deleted before it was read.
+func readMergedStateOnce(ctx context.Context, pipeline *PipelineConfig, numFiles int, fingerprint string) (*WorkerState, bool, error) {
+	files, err := storage.ListObjects(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, pipeline.getHash()+"_", "/")
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	w := createState(pipeline, numFiles)
+	w := createState(pipeline, numFiles, fingerprint)
 
 	var channels []chan WorkerStateResp
 	for _, f := range files {
@@ -87,15 +177,11 @@ func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int
 		channels = append(channels, channel)
 		go func(file string) {
 			var w WorkerStateResp
-			if !strings.HasPrefix(file, pipeline.getHash()) {
-				log.Warnf("Ignoring state file %s not matching transform hash %s", file, pipeline.getHash())
-				w.e = fmt.Errorf("ignoring state file %s", file)
-				channel <- w
-				return
-			}
 			reader, err := storage.GetObjectReader(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, file)
 			// The file could be deleted by the time we get to it.
 			if err != nil {
+				_, serr := storage.StatObject(ctx, pipeline.stateStorageProvider, pipeline.StateBucket, file)
+				w.deleted = errors.Is(serr, storage.ErrObjectNotExist)
 				w.e = err
 				channel <- w
 				return
@@ -104,13 +190,32 @@ func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int
 			if err == nil {
 				var currState WorkerState
 				currState.pipeline = pipeline
-				m, err := readFrom(reader)
+				s, err := decodeStateFile(reader)
 				reader.Close()
+				if err == nil && s.hash != "" && s.hash != pipeline.getHash() {
+					err = fmt.Errorf("written by the pipeline %s", s.hash)
+				}
 				if err != nil {
-					// ignore errors since these could happen due to concurrent deletes
-					// worst case this leads to duplicate work
-					log.Infof("Could not decode worker file %s %s", f, err)
+					// The file is left for inspection, the worst case is duplicate work on the objects it covers.
+					log.Errorf("Ignoring the corrupt state file %s, %v", file, err)
+					w.e = err
+					w.corrupt = true
+					channel <- w
+					return
+				}
+				m, stateFingerprint, granularity := s.m, s.fingerprint, s.granularity
+				// The files without one are legacy state, which is only resumed once migrateLegacyState checked its
+				// listing and rewrote it with the fingerprint.
+				if stateFingerprint != fingerprint {
+					log.Infof("Ignoring worker file %s written for a different source listing", file)
+					w.e = fmt.Errorf("fingerprint mismatch for state file %s", file)
+					channel <- w
+					return
+				}
+				if m, err = expandBitmap(m, granularity, numFiles); err != nil {
+					log.Errorf("Ignoring the corrupt state file %s, %v", file, err)
 					w.e = err
+					w.corrupt = true
 					channel <- w
 					return
 				}
@@ -122,8 +227,13 @@ func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int
 		}(f)
 	}
 
+	deleted := false
 	for i, c := range channels {
 		stateResp := <- c
+		deleted = deleted || stateResp.deleted
+		if stateResp.corrupt {
+			w.corruptFiles = append(w.corruptFiles, files[i])
+		}
 		if stateResp.e != nil {
 			continue
 		}
@@ -139,22 +249,24 @@ func ReadMergedState(ctx context.Context, pipeline *PipelineConfig, numFiles int
 		w.mergedFiles = append(w.mergedFiles, files[i])
 	}
 
-	return w, nil
+	return w, deleted, nil
 }
 
 func WriteState(ctx context.Context, stateBucket string, w *WorkerState) error {
-	c := make(chan error)
-	go func() {
-		writer, err := storage.GetObjectWriter(ctx, w.pipeline.stateStorageProvider, stateBucket, w.fileName())
-		if err != nil {
-			log.Debugf("Error in Writing %s %v", w.fileName(), err)
-			c <- err
-			return
-		}
-		w.m.writeTo(writer)
-		writer.Close()
-		c <- nil
-	}()
+	writer, err := storage.GetObjectWriter(ctx, w.pipeline.stateStorageProvider, stateBucket, w.fileName())
+	if err != nil {
+		log.Debugf("Error in Writing %s %v", w.fileName(), err)
+		return err
+	}
+	if err := w.writeTo(writer); err != nil {
+		writer.Abort(err)
+		return err
+	}
+	// The merged files are deleted only once the file which subsumes them is written, so that a concurrent
+	// ReadMergedState always finds their bits in one or the other.
+	if err := writer.Close(); err != nil {
+		return err
+	}
 
 	var wg sync.WaitGroup
 	for _, f := range w.mergedFiles {
@@ -163,12 +275,11 @@ func WriteState(ctx context.Context, stateBucket string, w *WorkerState) error {
 			// Ignore errors during delete since the object might be already deleted
 			err := storage.DeleteObject(ctx, w.pipeline.stateStorageProvider, stateBucket, file)
 			if err != nil {
-				log.Debugf("Error in deleting %s %v", f, err)
+				log.Debugf("Error in deleting %s %v", file, err)
 			}
 			wg.Done()
 		}(f)
 	}
 	wg.Wait()
-	err:= <- c
-	return err
+	return nil
 }
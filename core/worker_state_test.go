@@ -1,6 +1,9 @@
 package core
 
 import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/sharvanath/kromium/storage"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -8,3 +11,84 @@ import (
 func TestHasNonZeroBit(t *testing.T) {
 	assert.Equal(t, false, false)
 }
+
+func writeTestState(t *testing.T, config *PipelineConfig, numFiles int, processed ...int) *WorkerState {
+	w := createState(config, numFiles, "fingerprint")
+	w.workerId = uuid.New().String()
+	for _, p := range processed {
+		w.setProcessed(p)
+	}
+	assert.NoError(t, WriteState(context.Background(), config.StateBucket, w))
+	return w
+}
+
+func TestReadMergedStateMergesAllWorkers(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeTestState(t, config, 4*cBatchSize, 0)
+	writeTestState(t, config, 4*cBatchSize, 2)
+
+	w, err := ReadMergedState(context.Background(), config, 4*cBatchSize, "fingerprint")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(w.mergedFiles))
+	assert.True(t, w.m.isSet(0))
+	assert.False(t, w.m.isSet(1))
+	assert.True(t, w.m.isSet(2))
+}
+
+func TestReadMergedStateIgnoresStateDeletedDuringList(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeTestState(t, config, 4*cBatchSize, 0)
+	deleted := writeTestState(t, config, 4*cBatchSize, 2)
+
+	storage.SetMemoryFaults(config.StateBucket, storage.MemoryFaults{DeleteDuringList: []string{deleted.fileName()}})
+	w, err := ReadMergedState(context.Background(), config, 4*cBatchSize, "fingerprint")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(w.mergedFiles))
+	assert.True(t, w.m.isSet(0))
+	assert.False(t, w.m.isSet(2))
+}
+
+func TestReadMergedStateIgnoresOtherFingerprints(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeTestState(t, config, 4*cBatchSize, 0)
+
+	w, err := ReadMergedState(context.Background(), config, 4*cBatchSize, "other")
+	assert.NoError(t, err)
+	assert.Empty(t, w.mergedFiles)
+	assert.Equal(t, 0, w.m.usedSize())
+}
+
+func TestWriteStateDeletesMergedFiles(t *testing.T) {
+	config := setUpMemory(t, 0)
+	defer tearDownMemory(config)
+	writeTestState(t, config, 4*cBatchSize, 0)
+	writeTestState(t, config, 4*cBatchSize, 1)
+
+	w, err := ReadMergedState(context.Background(), config, 4*cBatchSize, "fingerprint")
+	assert.NoError(t, err)
+	w.workerId = uuid.New().String()
+	assert.NoError(t, WriteState(context.Background(), config.StateBucket, w))
+	assert.Equal(t, []string{w.fileName()}, listBucket(t, config.stateStorageProvider, config.StateBucket))
+}
+
+func TestFindProcessingRangeSkipsProcessedBatches(t *testing.T) {
+	w := createState(nil, 10, "fingerprint")
+	batches := []int{0, 3, 8}
+	for _, i := range []int{0, 1, 2, 3, 5, 6, 7} {
+		w.setProcessed(i)
+	}
+	for i := 0; i < 10; i++ {
+		start, end := w.findProcessingRange(batches)
+		assert.True(t, (start == 3 && end == 8) || (start == 8 && end == 10), "%d:%d", start, end)
+	}
+	w.setProcessed(4)
+	w.setProcessed(8)
+	start, end := w.findProcessingRange(batches)
+	assert.Equal(t, []int{8, 10}, []int{start, end})
+	w.setProcessed(9)
+	start, _ = w.findProcessingRange(batches)
+	assert.Equal(t, -1, start)
+}
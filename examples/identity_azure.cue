@@ -0,0 +1,15 @@
+{
+ SourceBucket: "az://kromium-src",
+ DestinationBucket: "az://kromium-dst",
+ StateBucket: "az://kromium-state",
+ Transforms: [
+   {
+     Type: "Identity"
+   }
+ ],
+ StorageConfig: {
+    AzureConfig: {
+      AccountName: "kromium"
+    }
+ }
+}
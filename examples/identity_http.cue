@@ -0,0 +1,18 @@
+{
+ SourceBucket: "https://example.com/datasets",
+ DestinationBucket: "file:///tmp/kromium-dst",
+ StateBucket: "file:///tmp/kromium-state",
+ Transforms: [
+   {
+     Type: "Identity"
+   }
+ ],
+ StorageConfig: {
+    HttpConfig: {
+      Manifest: "https://example.com/datasets/urls.txt",
+      Headers: {
+        Authorization: "Bearer ${DATASETS_TOKEN}"
+      }
+    }
+ }
+}
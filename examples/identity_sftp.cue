@@ -0,0 +1,15 @@
+{
+ SourceBucket: "sftp://kromium@sftp.example.com:22/data/src",
+ DestinationBucket: "file:///tmp/kromium-dst",
+ StateBucket: "file:///tmp/kromium-state",
+ Transforms: [
+   {
+     Type: "Identity"
+   }
+ ],
+ StorageConfig: {
+    SftpConfig: {
+      PrivateKeyPath: "/home/kromium/.ssh/id_ed25519"
+    }
+ }
+}
@@ -0,0 +1,15 @@
+{
+ SourceBucket: "file:///tmp/src",
+ DestinationBucket: "file:///tmp/dst",
+ StateBucket: "file:///tmp/state",
+ DestinationKey: "{{.ModTime.Format \"2006/01/02\"}}/{{.Rel}}.gz",
+ OnNameCollision: "hash",
+ Transforms: [
+   {
+     Type: "GzipCompress",
+     Args: {
+       level: 4
+     }
+   }
+ ]
+}
@@ -5,11 +5,15 @@ go 1.15
 require (
 	cloud.google.com/go/storage v1.18.2
 	cuelang.org/go v0.4.2
+	github.com/Azure/azure-storage-blob-go v0.15.0
 	github.com/aws/aws-sdk-go v1.44.4
 	github.com/gizak/termui/v3 v3.1.0
 	github.com/google/uuid v1.2.0
+	github.com/pkg/sftp v1.13.5
 	github.com/rwtodd/Go.Sed v0.0.0-20210816025313-55464686f9ef
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
 	google.golang.org/api v0.58.0
 )
@@ -11,16 +11,132 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"strings"
 )
 
 const version = "0.1.7"
 
+// The values of a flag which can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func initConfig(ctx context.Context, path string, readOnly bool) *core.PipelineConfig {
+	config, err := schema.ConvertToPipelineConfig(path)
+	if err != nil {
+		fmt.Println("Error reading the schema:", err)
+		os.Exit(1)
+	}
+	if readOnly {
+		err = config.InitReadOnly(ctx)
+	} else {
+		err = config.Init(ctx)
+	}
+	if err != nil {
+		fmt.Println("Error initializing the schema:", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+func printDeleted(files []string, yes bool) {
+	verb := "Deleted"
+	if !yes {
+		verb = "Would delete"
+	}
+	for _, f := range files {
+		fmt.Printf("%s %s\n", verb, f)
+	}
+	fmt.Printf("%s %d files\n", verb, len(files))
+	if !yes && len(files) > 0 {
+		fmt.Println("Run again with --yes to delete them")
+	}
+}
+
+// Inspects and manages the state bucket of the pipeline: kromium state show|reset|compact|gc --config pipeline.cue
+func runState(args []string) {
+	command := "show"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("state "+command, flag.ExitOnError)
+	var configPaths stringsFlag
+	flags.Var(&configPaths, "config", "The pipeline schema, gc keeps the state of every config given")
+	yes := flags.Bool("yes", false, "Delete the files with reset and gc, which otherwise only list them")
+	flags.Parse(args)
+	if len(configPaths) == 0 || (command != "gc" && len(configPaths) > 1) {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	// Only the commands which change the state clean up the temp files of the buckets.
+	readOnly := command == "show" || ((command == "reset" || command == "gc") && !*yes)
+	var configs []*core.PipelineConfig
+	for _, path := range configPaths {
+		config := initConfig(ctx, path, readOnly)
+		defer config.Close()
+		configs = append(configs, config)
+	}
+	var err error
+	switch command {
+	case "show":
+		var report *core.StateReport
+		if report, err = core.InspectState(ctx, configs[0]); err == nil {
+			report.Print(os.Stdout)
+		}
+	case "reset":
+		var files []string
+		if files, err = core.ResetState(ctx, configs[0], !*yes); err == nil {
+			printDeleted(files, *yes)
+		}
+	case "compact":
+		var merged int
+		var file string
+		if merged, file, err = core.CompactState(ctx, configs[0]); err == nil {
+			if file == "" {
+				fmt.Printf("Nothing to compact, %d state files\n", merged)
+			} else {
+				fmt.Printf("Compacted %d state files into %s\n", merged, file)
+			}
+		}
+	case "gc":
+		var files []string
+		if files, err = core.GarbageCollectState(ctx, configs, !*yes); err == nil {
+			printDeleted(files, *yes)
+		}
+	default:
+		fmt.Printf("Unknown state command %s, expected show, reset, compact or gc\n", command)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error in state %s: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		runState(os.Args[2:])
+		return
+	}
+
 	printVersion := flag.Bool("version", false, "Print version")
 	render := flag.Bool("render", true, "Render UI")
 	runConfig := flag.String("run", "", "Run the schema")
 	validate := flag.String("validate", "", "Validate the pipeline schema")
 	parallelism := flag.Int("P", runtime.GOMAXPROCS(0), "The parallelism for the run loop")
+	plan := flag.String("plan", "", "Print what a run of the schema would do, without writing anything")
+	planJSON := flag.Bool("json", false, "Print the plan as JSON")
+	bytesPerSecond := flag.Int64("bytes-per-second", 0, "The throughput of a worker assumed by the plan, 10 MiB/s by default")
+	retryFailed := flag.Bool("retry-failed", false, "Only process the objects in the dead-letter log of the run again")
 	flag.Parse()
 
 	go func() {
@@ -37,6 +153,19 @@ func main() {
 			os.Exit(1)
 		}
 		fmt.Printf("Successfuly validated %s\n", *validate)
+	} else if *plan != "" {
+		config := initConfig(context.Background(), *plan, true)
+		defer config.Close()
+		p, err := core.PlanPipeline(context.Background(), config, *parallelism, *bytesPerSecond)
+		if err != nil {
+			fmt.Println("Error planning the pipeline:", err)
+			os.Exit(1)
+		}
+		if *planJSON {
+			p.WriteJSON(os.Stdout)
+		} else {
+			p.Print(os.Stdout)
+		}
 	} else if runConfig != nil && *runConfig != "" {
 		fmt.Printf("Running %s\n", *runConfig)
 		config, err := schema.ConvertToPipelineConfig(*runConfig)
@@ -49,6 +178,13 @@ func main() {
 			os.Exit(1)
 		}
 		defer config.Close()
+		if *retryFailed {
+			if err = core.RetryFailed(context.Background(), config, *parallelism); err != nil {
+				fmt.Println("Error retrying the failed objects:", err)
+				os.Exit(1)
+			}
+			return
+		}
 		go func() {
 			if *render {
 				for e := range ui.PollEvents() {
@@ -48,23 +48,104 @@ var schema = `#BaseTransform: {
 
 #Transform: (#GzipCompress | #GzipDecompress | #Encrypt | #Decrypt | #Sed | #Identity)
 
-#Bucket: string & (=~"file:///" | =~"gs://" | =~"s3://")
+#Bucket: string & (=~"file:///" | =~"gs://" | =~"s3://" | =~"az://" | =~"mem://" | =~"sftp://")
+
+// The http(s) providers are read-only.
+#SourceBucket: #Bucket | (string & =~"^https?://")
 
 #S3Config: {
    Region?: string
+   Endpoint?: string
+   ForcePathStyle?: bool
+   PartSize?: int & >=5242880
+   Concurrency?: int & >0
+}
+
+#AzureConfig: {
+   AccountName?: string
+   AccountKey?: string
+   Endpoint?: string
+   BlockSize?: int & >0
+   Concurrency?: int & >0
+}
+
+#SftpConfig: {
+   PrivateKeyPath?: string
+   PrivateKey?: string
+   PrivateKeyPassphrase?: string
+   KnownHostsPath?: string
+   InsecureIgnoreHostKey?: bool
+}
+
+#HttpConfig: {
+   Manifest?: string
+   Headers?: [string]: string
 }
 
 #StorageConfig: {
    S3Config?: #S3Config
+   AzureConfig?: #AzureConfig
+   SftpConfig?: #SftpConfig
+   HttpConfig?: #HttpConfig
+}
+
+#MetadataConfig: {
+   Mode?: "preserve" | "drop" | "rewrite"
+   ContentType?: string
+   ContentEncoding?: string
+   CacheControl?: string
+   ContentDisposition?: string
+   ContentLanguage?: string
+   Custom?: [string]: string
+}
+
+#MirrorConfig: {
+   Enabled?: bool
+   MaxDeletePercent?: int & >=0 & <=100
+   DryRun?: bool
+}
+
+#RetryConfig: {
+   MaxAttempts?: int & >0
+   InitialBackoff?: string
+   MaxBackoff?: string
+   OnPermanentFailure?: "abort" | "skip"
+}
+
+#DeadLetterConfig: {
+   Enabled?: bool
+   QuarantineBucket?: #Bucket
+}
+
+#LeaseConfig: {
+   Enabled?: bool
+   Duration?: string
 }
 
 #Pipeline: {
- SourceBucket: #Bucket,
+ SourceBucket: #SourceBucket,
  DestinationBucket: #Bucket,
  StateBucket: #Bucket,
+ SourcePrefix?: string,
+ NonRecursive?: bool,
+ OnSourceChange?: "fail" | "replan",
  NameSuffix?: string,
  StripSuffix?: string,
+ OnNameCollision?: "fail" | "skip" | "hash" | "overwrite",
+ DestinationKey?: string,
+ DestinationKeyPattern?: string,
  Transforms: [...#Transform]
+ Mode?: "copy" | "sync"
+ Metadata?: #MetadataConfig
+ Mirror?: #MirrorConfig
+ DeleteSourceOnSuccess?: bool
+ Verify?: bool
+ Retry?: #RetryConfig
+ DeadLetter?: #DeadLetterConfig
+ Lease?: #LeaseConfig
+ BatchSize?: int & >0
+ BatchBytes?: int & >0
+ CleanTempFiles?: bool
  StorageConfig?: #StorageConfig
 }`
 
@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -16,3 +17,14 @@ func TestValidExampleConfigs(t *testing.T) {
 		assert.NoError(t, err, "test error reading examples dir")
 	}
 }
+
+func TestHttpIsOnlyValidAsSource(t *testing.T) {
+	config := `{
+ SourceBucket: "https://example.com/files",
+ DestinationBucket: "%s",
+ StateBucket: "file:///tmp/state",
+ Transforms: [{Type: "Identity"}]
+}`
+	assert.NoError(t, validatePipelineConfigString(fmt.Sprintf(config, "file:///tmp/dst")))
+	assert.Error(t, validatePipelineConfigString(fmt.Sprintf(config, "https://example.com/dst")))
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type AzureStorageProvider struct {
+	serviceURL azblob.ServiceURL
+	config     AzureConfig
+}
+
+func newAzureStorageProvider(config AzureConfig) (StorageProvider, error) {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		if config.AccountName == "" {
+			return nil, fmt.Errorf("either AccountName or Endpoint must be set in AzureConfig")
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", config.AccountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure endpoint %s, %v", endpoint, err)
+	}
+
+	accountKey := config.AccountKey
+	if accountKey == "" {
+		accountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	var credential azblob.Credential
+	if accountKey != "" {
+		credential, err = azblob.NewSharedKeyCredential(config.AccountName, accountKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Relies on a SAS token in the endpoint, or a publicly accessible container.
+		credential = azblob.NewAnonymousCredential()
+	}
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return &AzureStorageProvider{serviceURL: azblob.NewServiceURL(*u, p), config: config}, nil
+}
+
+func (a AzureStorageProvider) blobURL(bucket string, object string) azblob.BlockBlobURL {
+	return a.serviceURL.NewContainerURL(bucket).NewBlockBlobURL(object)
+}
+
+// The caller must close. Interrupted reads are resumed from the last read offset by the retry reader.
+func (a AzureStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	resp, err := a.blobURL(bucket, object).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false,
+		azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s/%s, %w", bucket, object, err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+func (a AzureStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	props, err := a.blobURL(bucket, object).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, err)
+	}
+	var metadata map[string]string
+	if m := props.NewMetadata(); len(m) > 0 {
+		metadata = m
+	}
+	return &ObjectAttrs{
+		ContentType:        props.ContentType(),
+		ContentEncoding:    props.ContentEncoding(),
+		CacheControl:       props.CacheControl(),
+		ContentDisposition: props.ContentDisposition(),
+		ContentLanguage:    props.ContentLanguage(),
+		Metadata:           metadata,
+		Size:               props.ContentLength(),
+		ModTime:            props.LastModified(),
+		MD5:                hex.EncodeToString(props.ContentMD5()),
+		ETag:               string(props.ETag()),
+	}, nil
+}
+
+// AzureObjectWriter feeds the written bytes through a pipe to a block blob upload running in the background. The
+// blocks are committed only when the writer is closed.
+type AzureObjectWriter struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func (o *AzureObjectWriter) Write(p []byte) (n int, err error) {
+	return o.w.Write(p)
+}
+
+func (o *AzureObjectWriter) Close() error {
+	o.w.Close()
+	return <-o.done
+}
+
+// Fails the upload before the block list is committed. The staged blocks are never part of the blob, and are garbage
+// collected by the service.
+func (o *AzureObjectWriter) Abort(err error) error {
+	if err == nil {
+		err = ErrAborted
+	}
+	o.w.CloseWithError(err)
+	<-o.done
+	return nil
+}
+
+func (a AzureStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	r, w := io.Pipe()
+	o := &AzureObjectWriter{w: w, done: make(chan error, 1)}
+	blobURL := a.blobURL(bucket, object)
+	options := azblob.UploadStreamToBlockBlobOptions{BufferSize: a.config.BlockSize, MaxBuffers: a.config.Concurrency}
+	if attrs != nil {
+		options.BlobHTTPHeaders = azblob.BlobHTTPHeaders{
+			ContentType:        attrs.ContentType,
+			ContentEncoding:    attrs.ContentEncoding,
+			CacheControl:       attrs.CacheControl,
+			ContentDisposition: attrs.ContentDisposition,
+			ContentLanguage:    attrs.ContentLanguage,
+		}
+		options.Metadata = attrs.Metadata
+	}
+	go func() {
+		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blobURL, options)
+		// Unblock any pending writes if the upload stopped early.
+		r.CloseWithError(err)
+		o.done <- err
+	}()
+	return o, nil
+}
+
+// Uploads with "If-None-Match: *", which fails with 409 (or 412) if the blob exists.
+func (a AzureStorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	_, err := azblob.UploadBufferToBlockBlob(ctx, content, a.blobURL(bucket, object), azblob.UploadToBlockBlobOptions{
+		AccessConditions: azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+		},
+	})
+	if status, ok := getStatusCode(err); ok && (status == http.StatusPreconditionFailed || status == http.StatusConflict) {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, ErrObjectExists)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, err)
+	}
+	return nil
+}
+
+func (a AzureStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
+	_, err := a.blobURL(bucket, object).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	return err
+}
+
+// Fetches one segment of the listing at a time.
+type azureObjectIterator struct {
+	ctx       context.Context
+	container azblob.ContainerURL
+	prefix    string
+	delimiter string
+	marker    azblob.Marker
+	page      []azblob.BlobItemInternal
+}
+
+func (i *azureObjectIterator) Next() (*ObjectInfo, error) {
+	for len(i.page) == 0 {
+		if !i.marker.NotDone() {
+			return nil, Done
+		}
+		options := azblob.ListBlobsSegmentOptions{Prefix: i.prefix}
+		if i.delimiter != "" {
+			resp, err := i.container.ListBlobsHierarchySegment(i.ctx, i.marker, i.delimiter, options)
+			if err != nil {
+				return nil, fmt.Errorf("error listing container %s. %w", i.container.String(), err)
+			}
+			// The blob prefixes (virtual folders) are skipped.
+			i.page = resp.Segment.BlobItems
+			i.marker = resp.NextMarker
+		} else {
+			resp, err := i.container.ListBlobsFlatSegment(i.ctx, i.marker, options)
+			if err != nil {
+				return nil, fmt.Errorf("error listing container %s. %w", i.container.String(), err)
+			}
+			i.page = resp.Segment.BlobItems
+			i.marker = resp.NextMarker
+		}
+	}
+	b := i.page[0]
+	i.page = i.page[1:]
+	var size int64
+	if b.Properties.ContentLength != nil {
+		size = *b.Properties.ContentLength
+	}
+	return &ObjectInfo{Name: b.Name, Size: size, ModTime: b.Properties.LastModified}, nil
+}
+
+func (a AzureStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	return &azureObjectIterator{ctx: ctx, container: a.serviceURL.NewContainerURL(bucket), prefix: prefix, delimiter: delimiter}
+}
+
+func (a AzureStorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
+	return strings.TrimPrefix(bucketFullName, "az://"), nil
+}
+
+func (a AzureStorageProvider) Close() error {
+	return nil
+}
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAzure is a minimal in-process stand-in for the blob service REST api of a single storage account, served under
+// /<account>/<container>/<blob> like the Azurite emulator.
+type fakeAzure struct {
+	sync.Mutex
+	account string
+	blobs   map[string][]byte
+	// The content and user metadata headers of the blobs, as returned on reads.
+	headers map[string]http.Header
+	// Staged but not yet committed blocks, by blob and block id.
+	blocks map[string]map[string][]byte
+	// The max number of blobs returned in one list segment.
+	pageSize  int
+	listCalls int
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{account: "devstoreaccount1", blobs: map[string][]byte{}, headers: map[string]http.Header{},
+		blocks: map[string]map[string][]byte{},
+		pageSize: 5000}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.account+"/")
+	query := r.URL.Query()
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		if r.Method == http.MethodGet && query.Get("comp") == "list" {
+			f.list(w, parts[0], query.Get("prefix"), query.Get("delimiter"), query.Get("marker"))
+			return
+		}
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	key := path
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		b, _ := ioutil.ReadAll(r.Body)
+		if f.blocks[key] == nil {
+			f.blocks[key] = map[string][]byte{}
+		}
+		f.blocks[key][query.Get("blockid")] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(b, &list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var blob bytes.Buffer
+		for _, id := range list.Latest {
+			block, ok := f.blocks[key][id]
+			if !ok {
+				writeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			blob.Write(block)
+		}
+		f.blobs[key] = blob.Bytes()
+		f.headers[key] = blobHeaders(r)
+		delete(f.blocks, key)
+		w.Header().Set("ETag", "\"etag\"")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if _, ok := f.blobs[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			writeAzureError(w, http.StatusConflict, "BlobAlreadyExists")
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		f.blobs[key] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.blobs[key]
+		if !ok {
+			writeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		for k, v := range f.headers[key] {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("ETag", "\"etag\"")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[key]; !ok {
+			writeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, key)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Maps the x-ms-blob-* headers of a commit to the headers returned on reads.
+func blobHeaders(r *http.Request) http.Header {
+	h := http.Header{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Ms-Meta-") {
+			h[k] = v
+		} else if strings.HasPrefix(k, "X-Ms-Blob-") && k != "X-Ms-Blob-Type" {
+			h[http.CanonicalHeaderKey(strings.TrimPrefix(k, "X-Ms-Blob-"))] = v
+		}
+	}
+	return h
+}
+
+func writeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// Lists the blobs in order. The marker is simply the last blob name returned.
+func (f *fakeAzure) list(w http.ResponseWriter, container string, prefix string, delimiter string, marker string) {
+	f.listCalls++
+	var names []string
+	for k := range f.blobs {
+		if strings.HasPrefix(k, container+"/"+prefix) {
+			names = append(names, strings.TrimPrefix(k, container+"/"))
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?><EnumerationResults><Blobs>")
+	count := 0
+	next := ""
+	truncated := false
+	seenPrefixes := map[string]bool{}
+	for _, n := range names {
+		if n <= marker {
+			continue
+		}
+		if count == f.pageSize {
+			truncated = true
+			break
+		}
+		rest := strings.TrimPrefix(n, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seenPrefixes[p] {
+				seenPrefixes[p] = true
+				fmt.Fprintf(&b, "<BlobPrefix><Name>%s</Name></BlobPrefix>", p)
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified>"+
+			"<Content-Length>%d</Content-Length><BlobType>BlockBlob</BlobType></Properties></Blob>",
+			n, time.Now().UTC().Format(http.TimeFormat), len(f.blobs[container+"/"+n]))
+		count++
+		next = n
+	}
+	if !truncated {
+		next = ""
+	}
+	fmt.Fprintf(&b, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(b.String()))
+}
+
+func newTestAzureStorageProvider(t *testing.T, f *fakeAzure) (StorageProvider, func()) {
+	server := httptest.NewServer(f)
+	s, err := newAzureStorageProvider(AzureConfig{
+		AccountName: f.account,
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("key")),
+		Endpoint:    server.URL + "/" + f.account,
+		BlockSize:   1024 * 1024,
+		Concurrency: 2,
+	})
+	assert.NoError(t, err)
+	return s, server.Close
+}
+
+func TestAzureRead(t *testing.T) {
+	f := newFakeAzure()
+	f.blobs["src/hello"] = []byte("hello world")
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	r, err := GetObjectReader(context.Background(), s, "az://src", "hello")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "hello world", string(b))
+
+	_, err = GetObjectReader(context.Background(), s, "az://src", "missing")
+	assert.Error(t, err)
+}
+
+func TestAzureWriteMultipleBlocks(t *testing.T) {
+	f := newFakeAzure()
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	w, err := GetObjectWriter(context.Background(), s, "az://dst", "large")
+	assert.NoError(t, err)
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var expected bytes.Buffer
+	for expected.Len() < 3*1024*1024+100 {
+		_, err = w.Write(chunk)
+		assert.NoError(t, err)
+		expected.Write(chunk)
+	}
+	assert.NoError(t, w.Close())
+	assert.True(t, bytes.Equal(expected.Bytes(), f.blobs["dst/large"]))
+	assert.Empty(t, f.blocks)
+}
+
+func TestAzureCreateObject(t *testing.T) {
+	f := newFakeAzure()
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	assert.NoError(t, CreateObject(context.Background(), s, "az://dst", "lease", []byte("a")))
+	err := CreateObject(context.Background(), s, "az://dst", "lease", []byte("b"))
+	assert.True(t, errors.Is(err, ErrObjectExists))
+	assert.Equal(t, "a", string(f.blobs["dst/lease"]))
+}
+
+func TestAzureDelete(t *testing.T) {
+	f := newFakeAzure()
+	f.blobs["src/a"] = []byte("a")
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	assert.NoError(t, DeleteObject(context.Background(), s, "az://src", "a"))
+	assert.Empty(t, f.blobs)
+	assert.Error(t, DeleteObject(context.Background(), s, "az://src", "a"))
+}
+
+func TestAzureListObjects(t *testing.T) {
+	f := newFakeAzure()
+	f.pageSize = 2
+	for _, k := range []string{"a/1", "a/2", "a/3", "a/b/4", "c/5"} {
+		f.blobs["src/"+k] = []byte("x")
+	}
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	objects, err := ListObjects(context.Background(), s, "az://src", "a/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2", "a/3", "a/b/4"}, objects)
+	assert.Equal(t, 2, f.listCalls)
+
+	objects, err = ListObjects(context.Background(), s, "az://src", "a/", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2", "a/3"}, objects)
+}
+
+func TestAzureAbort(t *testing.T) {
+	f := newFakeAzure()
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+
+	w, err := GetObjectWriter(context.Background(), s, "az://dst", "large")
+	assert.NoError(t, err)
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	for written := 0; written < 3*1024*1024; written += len(chunk) {
+		_, err = w.Write(chunk)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Abort(errors.New("transform failed")))
+	assert.Empty(t, f.blobs)
+}
+
+func TestAzureObjectAttrs(t *testing.T) {
+	f := newFakeAzure()
+	s, closer := newTestAzureStorageProvider(t, f)
+	defer closer()
+	attrs := &ObjectAttrs{ContentType: "text/plain", ContentEncoding: "gzip", CacheControl: "no-cache",
+		ContentDisposition: "attachment", ContentLanguage: "en", Metadata: map[string]string{"owner": "kromium"}}
+
+	w, err := GetObjectWriterWithAttrs(context.Background(), s, "az://dst", "a", attrs)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	stat, err := StatObject(context.Background(), s, "az://dst", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stat.Size)
+	assert.False(t, stat.ModTime.IsZero())
+	assert.NotEmpty(t, stat.ETag)
+	stat.Size = 0
+	stat.ModTime = time.Time{}
+	stat.ETag = ""
+	assert.Equal(t, attrs, stat)
+
+	_, err = StatObject(context.Background(), s, "az://dst", "missing")
+	assert.True(t, errors.Is(err, ErrObjectNotExist))
+}
+
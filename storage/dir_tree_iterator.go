@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type dirEntry struct {
+	// The path relative to the root, slash separated.
+	name string
+	info os.FileInfo
+}
+
+// Walks a folder tree depth first in lexical order, reading a folder only when the walk reaches it. Used by the
+// providers backed by a file system.
+type dirTreeIterator struct {
+	// Reads the folder, the path is relative to the root and slash separated.
+	readDir           func(dir string) ([]os.FileInfo, error)
+	prefix, delimiter string
+	// The entries yet to be visited, in reverse order so that the next one is at the end.
+	pending []dirEntry
+	err     error
+}
+
+func newDirTreeIterator(readDir func(dir string) ([]os.FileInfo, error), prefix string, delimiter string) *dirTreeIterator {
+	it := &dirTreeIterator{readDir: readDir, prefix: prefix, delimiter: delimiter}
+	// Only walk the folder which can contain the prefix.
+	start := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = prefix[:i]
+	}
+	if err := it.push(start); err != nil && !os.IsNotExist(err) {
+		it.err = err
+	}
+	return it
+}
+
+func (i *dirTreeIterator) push(dir string) error {
+	files, err := i.readDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Name() < files[b].Name() })
+	for j := len(files) - 1; j >= 0; j-- {
+		i.pending = append(i.pending, dirEntry{path.Join(dir, files[j].Name()), files[j]})
+	}
+	return nil
+}
+
+func (i *dirTreeIterator) Next() (*ObjectInfo, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	for len(i.pending) > 0 {
+		e := i.pending[len(i.pending)-1]
+		i.pending = i.pending[:len(i.pending)-1]
+		if e.info.IsDir() {
+			// With the "/" delimiter only the objects directly under the prefix folder are listed.
+			if i.delimiter == "/" {
+				continue
+			}
+			if err := i.push(e.name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasPrefix(e.name, i.prefix) {
+			continue
+		}
+		if i.delimiter != "" && strings.Contains(strings.TrimPrefix(e.name, i.prefix), i.delimiter) {
+			continue
+		}
+		return &ObjectInfo{Name: e.name, Size: e.info.Size(), ModTime: e.info.ModTime()}, nil
+	}
+	return nil, Done
+}
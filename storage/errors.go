@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"os"
+)
+
+// An unexpected status returned by an http(s) server.
+type httpStatusError struct {
+	url        string
+	statusCode int
+	status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("failed to get %s, %s", e.url, e.status)
+}
+
+// Returns the HTTP status of the error response of a provider, if it is one.
+func getStatusCode(err error) (int, bool) {
+	var httpErr *httpStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.statusCode, true
+	}
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) {
+		return gcsErr.Code, true
+	}
+	var s3Err awserr.RequestFailure
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode(), true
+	}
+	var azureErr azblob.StorageError
+	if errors.As(err, &azureErr) && azureErr.Response() != nil {
+		return azureErr.Response().StatusCode, true
+	}
+	return 0, false
+}
+
+// Returns true if the operation which failed with the error can succeed when retried: throttling (429), server errors
+// (5xx), request timeouts and unknown errors like dropped connections. The errors which do not go away on retry, like
+// missing objects, denied access, invalid requests (the other 4xx) and canceled contexts, are permanent.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrObjectNotExist) || errors.Is(err, ErrReadOnly) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, os.ErrPermission) {
+		return false
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "NoCredentialProviders" {
+		return false
+	}
+	if status, ok := getStatusCode(err); ok {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	}
+	return true
+}
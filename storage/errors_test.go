@@ -0,0 +1,38 @@
+package storage
+
+import (
+	gcs "cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset by peer"), true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("failed to read object b/o, %w", awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, "")), true},
+		{fmt.Errorf("failed to read object b/o, %w", awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "")), false},
+		{awserr.New("NoCredentialProviders", "", nil), false},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 401}, false},
+		{&httpStatusError{url: "http://a/b", statusCode: 502, status: "502 Bad Gateway"}, true},
+		{&httpStatusError{url: "http://a/b", statusCode: 410, status: "410 Gone"}, false},
+		{fmt.Errorf("failed to stat object b/o, %w", ErrObjectNotExist), false},
+		{wrapGcsError(gcs.ErrObjectNotExist, "read", "gs://b", "o"), false},
+		{&os.PathError{Op: "open", Path: "/a", Err: os.ErrPermission}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+	} {
+		assert.Equal(t, c.retryable, IsRetryable(c.err), "%v", c.err)
+	}
+}
@@ -3,9 +3,12 @@ package storage
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"google.golang.org/api/iterator"
 	"io"
+	"net/http"
 	"strings"
 )
 
@@ -29,34 +32,122 @@ func (g GcsStorageProvider) Close() error {
 	return g.client.Close()
 }
 
-func (g GcsStorageProvider) ListObjects(ctx context.Context, bucket string) ([]string, error) {
-	query := &storage.Query{Prefix: ""}
-	var names []string
-	it := g.client.Bucket(getBucketName(bucket)).Objects(ctx, query)
+type gcsObjectIterator struct {
+	it     *storage.ObjectIterator
+	bucket string
+}
+
+func (i *gcsObjectIterator) Next() (*ObjectInfo, error) {
 	for {
-		attrs, err := it.Next()
+		attrs, err := i.it.Next()
 		if err == iterator.Done {
-			break
+			return nil, Done
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error listing bucket %s. %v", bucket, err)
+			return nil, fmt.Errorf("error listing bucket %s. %w", i.bucket, err)
 		}
-		names = append(names, attrs.Name)
+		// Synthetic folder entries are returned when a delimiter is set.
+		if attrs.Prefix != "" {
+			continue
+		}
+		return &ObjectInfo{Name: attrs.Name, Size: attrs.Size, ModTime: attrs.Updated}, nil
 	}
-	return names, nil
 }
 
-// The caller must close
+func (g GcsStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	query := &storage.Query{Prefix: prefix, Delimiter: delimiter}
+	return &gcsObjectIterator{g.client.Bucket(getBucketName(bucket)).Objects(ctx, query), bucket}
+}
+
+// Maps the not found error of the client to ErrObjectNotExist, so that it is not retried.
+func wrapGcsError(err error, op string, bucket string, object string) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to %s object %s/%s, %w", op, bucket, object, ErrObjectNotExist)
+	}
+	return err
+}
+
+// The caller must close. The content is read as stored, i.e. gzip encoded objects are not decompressed.
 func (g GcsStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
-	return g.client.Bucket(getBucketName(bucket)).Object(object).NewReader(ctx)
+	reader, err := g.client.Bucket(getBucketName(bucket)).Object(object).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return nil, wrapGcsError(err, "read", bucket, object)
+	}
+	return reader, nil
 }
 
-func (g GcsStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string) (io.WriteCloser, error) {
-	return g.client.Bucket(getBucketName(bucket)).Object(object).NewWriter(ctx), nil
+func (g GcsStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	attrs, err := g.client.Bucket(getBucketName(bucket)).Object(object).Attrs(ctx)
+	if err != nil {
+		return nil, wrapGcsError(err, "stat", bucket, object)
+	}
+	return &ObjectAttrs{
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentLanguage:    attrs.ContentLanguage,
+		Metadata:           attrs.Metadata,
+		Size:               attrs.Size,
+		ModTime:            attrs.Updated,
+		MD5:                hex.EncodeToString(attrs.MD5),
+		CRC32C:             fmt.Sprintf("%08x", attrs.CRC32C),
+		ETag:               attrs.Etag,
+	}, nil
+}
+
+// GcsObjectWriter wraps the storage writer with the cancel func of its context, as cancelling the context is the way to
+// stop a write without publishing the object.
+type GcsObjectWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *GcsObjectWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func (w *GcsObjectWriter) Abort(err error) error {
+	w.cancel()
+	// Returns the context cancellation error, nothing has been written.
+	w.Writer.Close()
+	return nil
+}
+
+func (g GcsStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := g.client.Bucket(getBucketName(bucket)).Object(object).NewWriter(ctx)
+	if attrs != nil {
+		w.ContentType = attrs.ContentType
+		w.ContentEncoding = attrs.ContentEncoding
+		w.CacheControl = attrs.CacheControl
+		w.ContentDisposition = attrs.ContentDisposition
+		w.ContentLanguage = attrs.ContentLanguage
+		w.Metadata = attrs.Metadata
+	}
+	return &GcsObjectWriter{w, cancel}, nil
+}
+
+// Writes with the DoesNotExist precondition, which fails with 412 if the object exists.
+func (g GcsStorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := g.client.Bucket(getBucketName(bucket)).Object(object).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err := w.Write(content); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	err := w.Close()
+	if status, ok := getStatusCode(err); ok && status == http.StatusPreconditionFailed {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, ErrObjectExists)
+	}
+	return err
 }
 
 func (g GcsStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
-	return g.client.Bucket(getBucketName(bucket)).Object(object).Delete(ctx)
+	return wrapGcsError(g.client.Bucket(getBucketName(bucket)).Object(object).Delete(ctx), "delete", bucket, object)
 }
 
 func (g GcsStorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Returned by the writes and deletes of the read-only providers.
+var ErrReadOnly = errors.New("storage provider is read-only")
+
+// The max number of times an interrupted download is resumed.
+const cMaxHttpResumes = 3
+
+// HttpStorageProvider is a read-only provider for http:// and https:// uris. The object names are the paths relative to
+// the bucket url, e.g. the object a/b.txt of https://example.com/files is https://example.com/files/a/b.txt.
+type HttpStorageProvider struct {
+	client *http.Client
+	config HttpConfig
+}
+
+func newHttpStorageProvider(config HttpConfig) (StorageProvider, error) {
+	// The content is read as served, the transport must not decompress it.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	return &HttpStorageProvider{client: &http.Client{Transport: transport}, config: config}, nil
+}
+
+// Sends a GET with the configured headers. If offset is non-zero only the rest of the object is requested, and only
+// if it still matches the validator (an ETag or Last-Modified value).
+func (h HttpStorageProvider) get(ctx context.Context, u string, offset int64, validator string) (*http.Response, error) {
+	return h.do(ctx, http.MethodGet, u, offset, validator)
+}
+
+func (h HttpStorageProvider) do(ctx context.Context, method string, u string, offset int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.config.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %s, %w", u, ErrObjectNotExist)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &httpStatusError{url: u, statusCode: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
+}
+
+// Parses the bucket url, making sure the path ends with a "/" so that the object names resolve under it.
+func getHttpBaseUrl(bucket string) (*url.URL, error) {
+	base, err := url.Parse(bucket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http uri %s, %v", bucket, err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawPath = ""
+	return base, nil
+}
+
+func getHttpObjectUrl(bucket string, object string) (string, error) {
+	base, err := getHttpBaseUrl(bucket)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(&url.URL{Path: object}).String(), nil
+}
+
+// Returns the object name of the url, and false if the url is not under the base url.
+func getHttpObjectName(base *url.URL, u *url.URL) (string, bool) {
+	if u.Scheme != base.Scheme || u.Host != base.Host || !strings.HasPrefix(u.Path, base.Path) {
+		return "", false
+	}
+	return strings.TrimPrefix(u.Path, base.Path), true
+}
+
+// httpObjectReader resumes the download with a range request when the body is interrupted midway.
+type httpObjectReader struct {
+	ctx       context.Context
+	provider  HttpStorageProvider
+	url       string
+	validator string
+	body      io.ReadCloser
+	offset    int64
+	resumes   int
+}
+
+func (r *httpObjectReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || r.ctx.Err() != nil || r.resumes == cMaxHttpResumes || r.validator == "" {
+			return n, err
+		}
+		r.resumes++
+		r.body.Close()
+		resp, rerr := r.provider.get(r.ctx, r.url, r.offset, r.validator)
+		if rerr != nil {
+			return n, fmt.Errorf("failed to resume reading %s at offset %d after %v, %w", r.url, r.offset, err, rerr)
+		}
+		// A full response means that the range is not supported or the object has changed since the first request.
+		if resp.StatusCode != http.StatusPartialContent ||
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", r.offset)) {
+			resp.Body.Close()
+			statusErr := &httpStatusError{url: r.url, statusCode: resp.StatusCode, status: resp.Status}
+			return n, fmt.Errorf("failed to resume reading %s at offset %d after %v, %w", r.url, r.offset, err, statusErr)
+		}
+		r.body = resp.Body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *httpObjectReader) Close() error {
+	return r.body.Close()
+}
+
+// The caller must close. The download is resumed only if the server sends an ETag or Last-Modified header, so that a
+// changed object is never stitched together.
+func (h HttpStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	u, err := getHttpObjectUrl(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.get(ctx, u, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return &httpObjectReader{ctx: ctx, provider: h, url: u, validator: validator, body: resp.Body}, nil
+}
+
+// The attributes are taken from the response headers of a HEAD request.
+func (h HttpStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	u, err := getHttpObjectUrl(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.do(ctx, http.MethodHead, u, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	attrs := &ObjectAttrs{
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentEncoding:    resp.Header.Get("Content-Encoding"),
+		CacheControl:       resp.Header.Get("Cache-Control"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		ContentLanguage:    resp.Header.Get("Content-Language"),
+		Size:               resp.ContentLength,
+		ETag:               resp.Header.Get("ETag"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attrs.ModTime = t
+	}
+	return attrs, nil
+}
+
+func (h HttpStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	return nil, fmt.Errorf("cannot write %s to %s, %w", object, bucket, ErrReadOnly)
+}
+
+func (h HttpStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
+	return fmt.Errorf("cannot delete %s from %s, %w", object, bucket, ErrReadOnly)
+}
+
+// Reads the object urls from the manifest, one per line. Empty lines and lines starting with # are skipped.
+func (h HttpStorageProvider) readManifest(ctx context.Context, base *url.URL) ([]string, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(h.config.Manifest, "http://") || strings.HasPrefix(h.config.Manifest, "https://") {
+		resp, err := h.get(ctx, h.config.Manifest, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(h.config.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := base.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %s in manifest %s, %v", line, h.config.Manifest, err)
+		}
+		name, ok := getHttpObjectName(base, u)
+		if !ok || name == "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("url %s in manifest %s is not an object under %s", line, h.config.Manifest, base)
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+// Returns the href of all the links in the html page.
+func parseHtmlLinks(r io.Reader) ([]string, error) {
+	var links []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return links, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" {
+				continue
+			}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) == "href" {
+					links = append(links, string(v))
+				}
+			}
+		}
+	}
+}
+
+// Crawls the index pages starting at the base url, like the directory listings of static file servers. Links ending
+// with a "/" are sub folders, which are crawled only if recursive. Links outside the base url are ignored.
+func (h HttpStorageProvider) crawlIndex(ctx context.Context, base *url.URL, prefix string, recursive bool) ([]string, error) {
+	var names []string
+	visited := map[string]bool{"": true}
+	pending := []string{""}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+		page := base.ResolveReference(&url.URL{Path: dir})
+		resp, err := h.get(ctx, page.String(), 0, "")
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s. %v", page, err)
+		}
+		links, err := parseHtmlLinks(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the index page %s. %v", page, err)
+		}
+		for _, l := range links {
+			u, err := page.Parse(l)
+			if err != nil || u.RawQuery != "" {
+				continue
+			}
+			name, ok := getHttpObjectName(base, u)
+			if !ok || visited[name] {
+				continue
+			}
+			visited[name] = true
+			if strings.HasSuffix(name, "/") {
+				// Only crawl the folders which can contain the prefix.
+				if recursive && (strings.HasPrefix(name, prefix) || strings.HasPrefix(prefix, name)) {
+					pending = append(pending, name)
+				}
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// The listing is fetched on the first call to Next.
+type httpObjectIterator struct {
+	list   func() ([]string, error)
+	names  []string
+	listed bool
+}
+
+func (i *httpObjectIterator) Next() (*ObjectInfo, error) {
+	if !i.listed {
+		names, err := i.list()
+		if err != nil {
+			return nil, err
+		}
+		i.names = names
+		i.listed = true
+	}
+	if len(i.names) == 0 {
+		return nil, Done
+	}
+	name := i.names[0]
+	i.names = i.names[1:]
+	// The size and modification time are not known without a request per object.
+	return &ObjectInfo{Name: name}, nil
+}
+
+// Lists the objects in the manifest if one is configured, otherwise crawls the index page of the bucket url.
+func (h HttpStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	return &httpObjectIterator{list: func() ([]string, error) {
+		base, err := getHttpBaseUrl(bucket)
+		if err != nil {
+			return nil, err
+		}
+		var all []string
+		if h.config.Manifest != "" {
+			all, err = h.readManifest(ctx, base)
+		} else {
+			all, err = h.crawlIndex(ctx, base, prefix, delimiter == "")
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		seen := map[string]bool{}
+		for _, name := range all {
+			if seen[name] || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if delimiter != "" && strings.Contains(strings.TrimPrefix(name, prefix), delimiter) {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}}
+}
+
+func (h HttpStorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
+	return bucketFullName, nil
+}
+
+func (h HttpStorageProvider) Close() error {
+	return nil
+}
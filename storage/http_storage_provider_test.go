@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHttp serves the files under /files, with a folder listing page for every folder. Responses to full (non range)
+// requests are cut after truncateAt bytes, like an interrupted download.
+type fakeHttp struct {
+	sync.Mutex
+	files      map[string][]byte
+	truncateAt int
+	requests   int
+	headers    []http.Header
+}
+
+func (f *fakeHttp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	f.headers = append(f.headers, r.Header.Clone())
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		var page strings.Builder
+		page.WriteString("<html><body><a href=\"../\">Parent</a><a href=\"?C=N;O=D\">Name</a>\n")
+		for k := range f.files {
+			if rest := strings.TrimPrefix(k, name); strings.HasPrefix(k, name) {
+				if i := strings.Index(rest, "/"); i >= 0 {
+					rest = rest[:i+1]
+				}
+				page.WriteString("<a href=\"" + rest + "\">" + rest + "</a><br/>\n")
+			}
+		}
+		page.WriteString("<a href=\"http://elsewhere.com/x\">x</a></body></html>")
+		w.Write([]byte(page.String()))
+		return
+	}
+	b, ok := f.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", "\"v1\"")
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Header.Get("Range") == "" && f.truncateAt > 0 && f.truncateAt < len(b) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b[:f.truncateAt])
+		return
+	}
+	http.ServeContent(w, r, name, time.Unix(1600000000, 0), bytes.NewReader(b))
+}
+
+func newTestHttpStorageProvider(t *testing.T, config HttpConfig) (*fakeHttp, StorageProvider, string, func()) {
+	f := &fakeHttp{files: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	s, err := GetStorageProvider(context.Background(), server.URL, &StorageConfig{HttpConfig: config})
+	assert.NoError(t, err)
+	return f, s, server.URL + "/files", server.Close
+}
+
+func TestHttpRead(t *testing.T) {
+	os.Setenv("KROMIUM_TEST_TOKEN", "secret")
+	defer os.Unsetenv("KROMIUM_TEST_TOKEN")
+	f, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{
+		Headers: map[string]string{"Authorization": "Bearer ${KROMIUM_TEST_TOKEN}"}})
+	defer closer()
+	f.files["dir/a b.txt"] = []byte("hello")
+
+	r, err := GetObjectReader(context.Background(), s, uri, "dir/a b.txt")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "hello", string(b))
+	assert.Equal(t, "Bearer secret", f.headers[0].Get("Authorization"))
+
+	_, err = GetObjectReader(context.Background(), s, uri, "missing")
+	assert.Error(t, err)
+}
+
+func TestHttpReadResumesInterruptedDownload(t *testing.T) {
+	f, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{})
+	defer closer()
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	f.files["big"] = data
+	f.truncateAt = 12345
+
+	r, err := GetObjectReader(context.Background(), s, uri, "big")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.True(t, bytes.Equal(data, b))
+	assert.Equal(t, 2, f.requests)
+	assert.Equal(t, "bytes=12345-", f.headers[1].Get("Range"))
+	assert.Equal(t, "\"v1\"", f.headers[1].Get("If-Range"))
+}
+
+func TestHttpIsReadOnly(t *testing.T) {
+	_, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{})
+	defer closer()
+
+	_, err := GetObjectWriter(context.Background(), s, uri, "a")
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.True(t, errors.Is(DeleteObject(context.Background(), s, uri, "a"), ErrReadOnly))
+}
+
+func TestHttpListIndexPage(t *testing.T) {
+	f, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{})
+	defer closer()
+	for _, k := range []string{"b", "a", "sub/c", "sub/nested/d", "other/e"} {
+		f.files[k] = []byte(k)
+	}
+
+	objects, err := ListObjects(context.Background(), s, uri, "", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+	objects, err = ListObjects(context.Background(), s, uri, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "other/e", "sub/c", "sub/nested/d"}, objects)
+
+	f.requests = 0
+	objects, err = ListObjects(context.Background(), s, uri, "sub/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sub/c", "sub/nested/d"}, objects)
+	// The other folder is not crawled.
+	assert.Equal(t, 3, f.requests)
+}
+
+func TestHttpListManifest(t *testing.T) {
+	manifest, err := ioutil.TempFile("", "urls")
+	assert.NoError(t, err)
+	defer os.Remove(manifest.Name())
+	_, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{Manifest: manifest.Name()})
+	defer closer()
+
+	manifest.WriteString("# the urls\n" + uri + "/x/1\n\nrelative/2\n" + uri + "/0\n")
+	manifest.Close()
+	objects, err := ListObjects(context.Background(), s, uri, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "relative/2", "x/1"}, objects)
+
+	assert.NoError(t, ioutil.WriteFile(manifest.Name(), []byte("http://elsewhere.com/files/1\n"), 0644))
+	_, err = ListObjects(context.Background(), s, uri, "", "")
+	assert.Error(t, err)
+}
+
+func TestHttpStatObject(t *testing.T) {
+	f, s, uri, closer := newTestHttpStorageProvider(t, HttpConfig{})
+	defer closer()
+	f.files["a"] = []byte("hello")
+
+	attrs, err := StatObject(context.Background(), s, uri, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", attrs.ContentType)
+	assert.Equal(t, int64(5), attrs.Size)
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), attrs.ModTime.UTC())
+	assert.Equal(t, "\"v1\"", attrs.ETag)
+
+	_, err = StatObject(context.Background(), s, uri, "missing")
+	assert.True(t, errors.Is(err, ErrObjectNotExist))
+}
+
@@ -2,29 +2,47 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// The objects are written to temp files with this prefix, which are renamed once fully written.
+const cLocalTempPrefix = ".kromium-tmp-"
+
 type LocalStorageProvider struct {}
 
 func getFolderName(bucket string) string {
 	return strings.TrimPrefix(bucket, "file://")
 }
 
-func (l LocalStorageProvider) ListObjects(ctx context.Context, bucket string) ([]string, error) {
-	files, err := ioutil.ReadDir(getFolderName(bucket))
-	if err != nil {
-		return nil, err
+func (l LocalStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	root := getFolderName(bucket)
+	if _, err := os.Stat(root); err != nil {
+		return &dirTreeIterator{err: err}
 	}
+	return newDirTreeIterator(func(dir string) ([]os.FileInfo, error) {
+		files, err := ioutil.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil {
+			return nil, err
+		}
+		return withoutTempFiles(files), nil
+	}, prefix, delimiter)
+}
 
-	var names []string
+// The objects being written are not listed.
+func withoutTempFiles(files []os.FileInfo) []os.FileInfo {
+	listed := files[:0]
 	for _, f := range files {
-		names = append(names, f.Name())
+		if !strings.HasPrefix(f.Name(), cLocalTempPrefix) {
+			listed = append(listed, f)
+		}
 	}
-	return names, nil
+	return listed
 }
 
 func (l LocalStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
@@ -35,12 +53,129 @@ func (l LocalStorageProvider) ObjectReader(ctx context.Context, bucket string, o
 	return f, nil
 }
 
-func (g LocalStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string) (io.WriteCloser, error) {
-	f, err := os.OpenFile(getFolderName(bucket) + "/" + object, os.O_CREATE|os.O_WRONLY, 0644)
+// LocalObjectWriter writes to a temp file in the destination folder, which replaces the object only when the writer is
+// closed. So a crash midway never leaves a partially written object behind.
+type LocalObjectWriter struct {
+	f     *os.File
+	name  string
+	attrs *ObjectAttrs
+}
+
+func (w *LocalObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *LocalObjectWriter) Close() error {
+	mode := os.FileMode(0644)
+	if w.attrs != nil && w.attrs.Mode != 0 {
+		mode = w.attrs.Mode.Perm()
+	}
+	err := w.f.Sync()
+	if err == nil {
+		err = w.f.Chmod(mode)
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && w.attrs != nil && !w.attrs.ModTime.IsZero() {
+		err = os.Chtimes(w.f.Name(), w.attrs.ModTime, w.attrs.ModTime)
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.name)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	// Persist the rename, not all the file systems support syncing a folder so the error is ignored.
+	if d, err := os.Open(filepath.Dir(w.name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Removes the temp file, the object is left untouched.
+func (w *LocalObjectWriter) Abort(err error) error {
+	w.f.Close()
+	if rerr := os.Remove(w.f.Name()); rerr != nil && !os.IsNotExist(rerr) {
+		return rerr
+	}
+	return nil
+}
+
+// Only the modification time and the permission bits are kept by the file system.
+func (g LocalStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	info, err := os.Stat(getFolderName(bucket) + "/" + object)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	return &ObjectAttrs{Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode().Perm()}, nil
+}
+
+func (g LocalStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	name := getFolderName(bucket) + "/" + object
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), cLocalTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalObjectWriter{f: f, name: name, attrs: attrs}, nil
+}
+
+// Creates the file with O_EXCL, so only one of the concurrent creators succeeds.
+func (g LocalStorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	name := getFolderName(bucket) + "/" + object
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, ErrObjectExists)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// Removes the temp files left behind by writers which were never closed, e.g. when the process crashed. Only the ones
+// not modified for olderThan are removed, as the others could still be written by another worker.
+func (g LocalStorageProvider) CleanTempFiles(ctx context.Context, bucket string, olderThan time.Duration) (int, error) {
+	root := getFolderName(bucket)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return 0, nil
+	}
+	removed := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), cLocalTempPrefix) || time.Since(info.ModTime()) < olderThan {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
 }
 
 func (g LocalStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
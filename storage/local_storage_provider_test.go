@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createLocalFiles(t *testing.T, names ...string) string {
+	dir, err := ioutil.TempDir("", "local_storage_test")
+	assert.NoError(t, err)
+	for _, n := range names {
+		path := filepath.Join(dir, filepath.FromSlash(n))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(n), 0600))
+	}
+	return dir
+}
+
+func TestLocalListObjectsTopLevel(t *testing.T) {
+	dir := createLocalFiles(t, "a", "b", "sub/c", "sub/nested/d")
+	defer os.RemoveAll(dir)
+
+	objects, err := ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+}
+
+func TestLocalListObjectsRecursive(t *testing.T) {
+	dir := createLocalFiles(t, "a", "b", "sub/c", "sub/nested/d")
+	defer os.RemoveAll(dir)
+
+	objects, err := ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "sub/c", "sub/nested/d"}, objects)
+}
+
+func TestLocalListObjectsPrefix(t *testing.T) {
+	dir := createLocalFiles(t, "a", "sub/c", "sub/cc", "sub/d", "sub/nested/e")
+	defer os.RemoveAll(dir)
+
+	objects, err := ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "sub/c", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sub/c", "sub/cc"}, objects)
+
+	objects, err = ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "sub/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sub/c", "sub/cc", "sub/d", "sub/nested/e"}, objects)
+
+	objects, err = ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "missing/", "")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestLocalWriteNestedObject(t *testing.T) {
+	dir := createLocalFiles(t)
+	defer os.RemoveAll(dir)
+
+	w, err := GetObjectWriter(context.Background(), LocalStorageProvider{}, "file://"+dir, "x/y/z")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "x", "y", "z"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestLocalListObjectsMissingFolder(t *testing.T) {
+	_, err := ListObjects(context.Background(), LocalStorageProvider{}, "file:///tmp/kromium_missing_folder", "", "/")
+	assert.Error(t, err)
+}
+
+func TestLocalIteratorReturnsSize(t *testing.T) {
+	dir := createLocalFiles(t, "abc", "sub/de")
+	defer os.RemoveAll(dir)
+
+	it := LocalStorageProvider{}.IterateObjects(context.Background(), dir, "", "")
+	o, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", o.Name)
+	assert.Equal(t, int64(3), o.Size)
+	o, err = it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "sub/de", o.Name)
+	assert.Equal(t, int64(6), o.Size)
+	_, err = it.Next()
+	assert.Equal(t, Done, err)
+}
+
+func TestLocalWriteReplacesLongerObject(t *testing.T) {
+	dir := createLocalFiles(t, "a")
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a much longer content"), 0600))
+
+	w, err := GetObjectWriter(context.Background(), LocalStorageProvider{}, "file://"+dir, "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("short"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "short", string(b))
+}
+
+func TestLocalWriteIsInvisibleUntilClosed(t *testing.T) {
+	dir := createLocalFiles(t, "a")
+	defer os.RemoveAll(dir)
+
+	w, err := GetObjectWriter(context.Background(), LocalStorageProvider{}, "file://"+dir, "b")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+	objects, err := ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, objects)
+
+	assert.NoError(t, w.Close())
+	objects, err = ListObjects(context.Background(), LocalStorageProvider{}, "file://"+dir, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+	info, err := os.Stat(filepath.Join(dir, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestLocalCleanTempFiles(t *testing.T) {
+	dir := createLocalFiles(t, "a")
+	defer os.RemoveAll(dir)
+	p := &LocalStorageProvider{}
+	stale, err := p.ObjectWriter(context.Background(), dir, "sub/stale", nil)
+	assert.NoError(t, err)
+	staleFile := stale.(*LocalObjectWriter).f
+	staleFile.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(staleFile.Name(), old, old))
+	fresh, err := p.ObjectWriter(context.Background(), dir, "fresh", nil)
+	assert.NoError(t, err)
+
+	n, err := CleanTempFiles(context.Background(), p, "file://"+dir, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = os.Stat(staleFile.Name())
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, fresh.Close())
+	objects, err := ListObjects(context.Background(), p, "file://"+dir, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "fresh"}, objects)
+
+	n, err = CleanTempFiles(context.Background(), MemoryStorageProvider{}, "mem://x", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLocalAbortKeepsExistingObject(t *testing.T) {
+	dir := createLocalFiles(t, "a")
+	defer os.RemoveAll(dir)
+
+	w, err := GetObjectWriter(context.Background(), LocalStorageProvider{}, "file://"+dir, "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort(nil))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(b))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestLocalCreateObject(t *testing.T) {
+	dir := createLocalFiles(t, "a")
+	defer os.RemoveAll(dir)
+
+	err := CreateObject(context.Background(), LocalStorageProvider{}, "file://"+dir, "a", []byte("b"))
+	assert.True(t, errors.Is(err, ErrObjectExists))
+	assert.NoError(t, CreateObject(context.Background(), LocalStorageProvider{}, "file://"+dir, "dir/b", []byte("b")))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dir", "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(b))
+}
+
+func TestLocalObjectAttrs(t *testing.T) {
+	dir := createLocalFiles(t)
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	w, err := GetObjectWriterWithAttrs(context.Background(), LocalStorageProvider{}, "file://"+dir, "a",
+		&ObjectAttrs{ContentType: "text/plain", ModTime: mtime, Mode: 0600})
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	attrs, err := StatObject(context.Background(), LocalStorageProvider{}, "file://"+dir, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), attrs.Size)
+	assert.True(t, mtime.Equal(attrs.ModTime))
+	assert.Equal(t, os.FileMode(0600), attrs.Mode)
+	// Not kept by the file system.
+	assert.Equal(t, "", attrs.ContentType)
+
+	_, err = StatObject(context.Background(), LocalStorageProvider{}, "file://"+dir, "missing")
+	assert.True(t, errors.Is(err, ErrObjectNotExist))
+}
+
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults injected in a memory bucket, so that failures and races can be tested deterministically.
+type MemoryFaults struct {
+	// Fail the Nth (1-based) ObjectReader call on the bucket. 0 disables it.
+	FailReadN int
+	// Sleep for the duration on every Write.
+	WriteDelay time.Duration
+	// Reads of these objects return only the given number of bytes, followed by a clean EOF.
+	Truncate map[string]int
+	// These objects are returned by the next listing but deleted right after it, like a concurrent delete would.
+	DeleteDuringList []string
+	// Closing the writers of these objects fails with the error instead of committing them.
+	FailClose map[string]error
+}
+
+type memoryObject struct {
+	data  []byte
+	attrs ObjectAttrs
+}
+
+type memoryBucket struct {
+	objects map[string]*memoryObject
+	faults  MemoryFaults
+	reads   int
+}
+
+// All the memory buckets live for the lifetime of the process, and are shared by all the MemoryStorageProvider
+// instances.
+var memoryBuckets = struct {
+	sync.Mutex
+	buckets map[string]*memoryBucket
+}{buckets: make(map[string]*memoryBucket)}
+
+// The caller must hold the lock.
+func getMemoryBucket(bucket string) *memoryBucket {
+	b, ok := memoryBuckets.buckets[bucket]
+	if !ok {
+		b = &memoryBucket{objects: make(map[string]*memoryObject)}
+		memoryBuckets.buckets[bucket] = b
+	}
+	return b
+}
+
+// Sets the faults for the bucket, e.g. SetMemoryFaults("mem://src", MemoryFaults{FailReadN: 2}).
+func SetMemoryFaults(bucket string, faults MemoryFaults) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	b := getMemoryBucket(strings.TrimPrefix(bucket, "mem://"))
+	b.faults = faults
+	b.reads = 0
+}
+
+// Removes all the objects and faults of the bucket.
+func ResetMemoryBucket(bucket string) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	delete(memoryBuckets.buckets, strings.TrimPrefix(bucket, "mem://"))
+}
+
+// MemoryStorageProvider keeps the objects in memory, it is used for tests and dry runs.
+type MemoryStorageProvider struct{}
+
+func (m MemoryStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	b := getMemoryBucket(bucket)
+	b.reads++
+	if b.faults.FailReadN == b.reads {
+		return nil, fmt.Errorf("injected failure reading object %s/%s", bucket, object)
+	}
+	o, ok := b.objects[object]
+	if !ok {
+		return nil, fmt.Errorf("failed to read object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	data := o.data
+	if n, ok := b.faults.Truncate[object]; ok && n < len(data) {
+		data = data[:n]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// MemoryObjectWriter buffers the object, which becomes visible only when the writer is closed.
+type MemoryObjectWriter struct {
+	buf    bytes.Buffer
+	delay  time.Duration
+	bucket string
+	object string
+	attrs  ObjectAttrs
+	// Set once aborted, the object is then never committed.
+	aborted error
+	// Fail the commit with ErrObjectExists if the object exists.
+	ifNotExist bool
+}
+
+func (w *MemoryObjectWriter) Write(p []byte) (int, error) {
+	if w.aborted != nil {
+		return 0, w.aborted
+	}
+	if w.delay > 0 {
+		time.Sleep(w.delay)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *MemoryObjectWriter) Abort(err error) error {
+	if err == nil {
+		err = ErrAborted
+	}
+	w.aborted = err
+	w.buf.Reset()
+	return nil
+}
+
+func (w *MemoryObjectWriter) Close() error {
+	if w.aborted != nil {
+		return w.aborted
+	}
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	if err, ok := getMemoryBucket(w.bucket).faults.FailClose[w.object]; ok {
+		return fmt.Errorf("failed to commit object %s/%s, %w", w.bucket, w.object, err)
+	}
+	if _, ok := getMemoryBucket(w.bucket).objects[w.object]; ok && w.ifNotExist {
+		return fmt.Errorf("failed to create object %s/%s, %w", w.bucket, w.object, ErrObjectExists)
+	}
+	attrs := w.attrs
+	attrs.Size = int64(w.buf.Len())
+	sum := md5.Sum(w.buf.Bytes())
+	attrs.MD5 = hex.EncodeToString(sum[:])
+	attrs.ETag = "\"" + attrs.MD5 + "\""
+	attrs.CRC32C = fmt.Sprintf("%08x", crc32.Checksum(w.buf.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	if attrs.ModTime.IsZero() {
+		attrs.ModTime = time.Now()
+	}
+	getMemoryBucket(w.bucket).objects[w.object] = &memoryObject{data: w.buf.Bytes(), attrs: attrs}
+	return nil
+}
+
+// All the attributes are kept, like a file system the modification time can be set.
+func (m MemoryStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	w := &MemoryObjectWriter{delay: getMemoryBucket(bucket).faults.WriteDelay, bucket: bucket, object: object}
+	if attrs != nil {
+		w.attrs = *attrs.Copy()
+	}
+	return w, nil
+}
+
+func (m MemoryStorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	w, err := m.ObjectWriter(ctx, bucket, object, nil)
+	if err != nil {
+		return err
+	}
+	mw := w.(*MemoryObjectWriter)
+	mw.buf.Write(content)
+	mw.ifNotExist = true
+	return mw.Close()
+}
+
+func (m MemoryStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	o, ok := getMemoryBucket(bucket).objects[object]
+	if !ok {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	return o.attrs.Copy(), nil
+}
+
+func (m MemoryStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	b := getMemoryBucket(bucket)
+	if _, ok := b.objects[object]; !ok {
+		return fmt.Errorf("failed to delete object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	delete(b.objects, object)
+	return nil
+}
+
+type memoryObjectIterator struct {
+	objects []ObjectInfo
+}
+
+func (i *memoryObjectIterator) Next() (*ObjectInfo, error) {
+	if len(i.objects) == 0 {
+		return nil, Done
+	}
+	o := i.objects[0]
+	i.objects = i.objects[1:]
+	return &o, nil
+}
+
+// The listing is a snapshot taken when the iterator is created.
+func (m MemoryStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	memoryBuckets.Lock()
+	defer memoryBuckets.Unlock()
+	b := getMemoryBucket(bucket)
+	it := &memoryObjectIterator{}
+	for name, o := range b.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(name, prefix), delimiter) {
+			continue
+		}
+		it.objects = append(it.objects, ObjectInfo{Name: name, Size: int64(len(o.data)), ModTime: o.attrs.ModTime})
+	}
+	sort.Slice(it.objects, func(i, j int) bool { return it.objects[i].Name < it.objects[j].Name })
+
+	for _, name := range b.faults.DeleteDuringList {
+		delete(b.objects, name)
+	}
+	b.faults.DeleteDuringList = nil
+	return it
+}
+
+func (m MemoryStorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
+	return strings.TrimPrefix(bucketFullName, "mem://"), nil
+}
+
+func (m MemoryStorageProvider) Close() error {
+	return nil
+}
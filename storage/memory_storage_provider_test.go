@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func writeMemoryObject(t *testing.T, bucket string, object string, data string) {
+	w, err := GetObjectWriter(context.Background(), MemoryStorageProvider{}, bucket, object)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+}
+
+func readMemoryObject(bucket string, object string) (string, error) {
+	r, err := GetObjectReader(context.Background(), MemoryStorageProvider{}, bucket, object)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func TestMemoryReadWrite(t *testing.T) {
+	defer ResetMemoryBucket("mem://rw")
+	writeMemoryObject(t, "mem://rw", "a", "hello")
+	data, err := readMemoryObject("mem://rw", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", data)
+
+	// A different provider instance sees the same bucket.
+	p, err := GetStorageProvider(context.Background(), "mem://rw", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, DeleteObject(context.Background(), p, "mem://rw", "a"))
+	_, err = readMemoryObject("mem://rw", "a")
+	assert.Error(t, err)
+}
+
+func TestMemoryObjectVisibleOnlyAfterClose(t *testing.T) {
+	defer ResetMemoryBucket("mem://close")
+	w, err := GetObjectWriter(context.Background(), MemoryStorageProvider{}, "mem://close", "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = readMemoryObject("mem://close", "a")
+	assert.Error(t, err)
+	assert.NoError(t, w.Close())
+	_, err = readMemoryObject("mem://close", "a")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCreateObject(t *testing.T) {
+	defer ResetMemoryBucket("mem://create")
+	assert.NoError(t, CreateObject(context.Background(), MemoryStorageProvider{}, "mem://create", "a", []byte("1")))
+	err := CreateObject(context.Background(), MemoryStorageProvider{}, "mem://create", "a", []byte("2"))
+	assert.True(t, errors.Is(err, ErrObjectExists))
+	data, err := readMemoryObject("mem://create", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", data)
+}
+
+func TestMemoryListObjects(t *testing.T) {
+	defer ResetMemoryBucket("mem://list")
+	for _, o := range []string{"b", "a", "dir/c", "dir/sub/d"} {
+		writeMemoryObject(t, "mem://list", o, o)
+	}
+	objects, err := ListObjects(context.Background(), MemoryStorageProvider{}, "mem://list", "", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+	objects, err = ListObjects(context.Background(), MemoryStorageProvider{}, "mem://list", "dir/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir/c", "dir/sub/d"}, objects)
+}
+
+func TestMemoryFailNthRead(t *testing.T) {
+	defer ResetMemoryBucket("mem://fail")
+	writeMemoryObject(t, "mem://fail", "a", "hello")
+	SetMemoryFaults("mem://fail", MemoryFaults{FailReadN: 2})
+	_, err := readMemoryObject("mem://fail", "a")
+	assert.NoError(t, err)
+	_, err = readMemoryObject("mem://fail", "a")
+	assert.Error(t, err)
+	_, err = readMemoryObject("mem://fail", "a")
+	assert.NoError(t, err)
+}
+
+func TestMemoryTruncatedObject(t *testing.T) {
+	defer ResetMemoryBucket("mem://truncate")
+	writeMemoryObject(t, "mem://truncate", "a", "hello")
+	SetMemoryFaults("mem://truncate", MemoryFaults{Truncate: map[string]int{"a": 2}})
+	data, err := readMemoryObject("mem://truncate", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "he", data)
+}
+
+func TestMemorySlowWriter(t *testing.T) {
+	defer ResetMemoryBucket("mem://slow")
+	SetMemoryFaults("mem://slow", MemoryFaults{WriteDelay: 20 * time.Millisecond})
+	start := time.Now()
+	writeMemoryObject(t, "mem://slow", "a", "hello")
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestMemoryDeleteDuringList(t *testing.T) {
+	defer ResetMemoryBucket("mem://deletelist")
+	writeMemoryObject(t, "mem://deletelist", "a", "a")
+	writeMemoryObject(t, "mem://deletelist", "b", "b")
+	SetMemoryFaults("mem://deletelist", MemoryFaults{DeleteDuringList: []string{"a"}})
+	objects, err := ListObjects(context.Background(), MemoryStorageProvider{}, "mem://deletelist", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+	_, err = readMemoryObject("mem://deletelist", "a")
+	assert.Error(t, err)
+	objects, err = ListObjects(context.Background(), MemoryStorageProvider{}, "mem://deletelist", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, objects)
+}
+
+func TestMemoryAbort(t *testing.T) {
+	defer ResetMemoryBucket("mem://abort")
+	p := MemoryStorageProvider{}
+	w, err := GetObjectWriter(context.Background(), p, "mem://abort", "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort(nil))
+	assert.Equal(t, ErrAborted, w.Close())
+	_, err = GetObjectReader(context.Background(), p, "mem://abort", "a")
+	assert.Error(t, err)
+}
+
+func TestMemoryObjectAttrs(t *testing.T) {
+	defer ResetMemoryBucket("mem://attrs")
+	p := MemoryStorageProvider{}
+	attrs := &ObjectAttrs{ContentType: "text/plain", Metadata: map[string]string{"a": "1"}}
+	w, err := GetObjectWriterWithAttrs(context.Background(), p, "mem://attrs", "a", attrs)
+	assert.NoError(t, err)
+	// The writer keeps its own copy.
+	attrs.Metadata["a"] = "2"
+	w.Write([]byte("hello"))
+	assert.NoError(t, w.Close())
+
+	stat, err := StatObject(context.Background(), p, "mem://attrs", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", stat.ContentType)
+	assert.Equal(t, map[string]string{"a": "1"}, stat.Metadata)
+	assert.Equal(t, int64(5), stat.Size)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", stat.MD5)
+	assert.Equal(t, "9a71bb4c", stat.CRC32C)
+
+	_, err = StatObject(context.Background(), p, "mem://attrs", "missing")
+	assert.True(t, errors.Is(err, ErrObjectNotExist))
+}
+
@@ -1,81 +1,186 @@
 package storage
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"strings"
 )
 
-const DEFAULT_FILE_BUF_SIZE_BYTES int = 10*1024
-
 type S3StorageProvider struct {
 	session *session.Session
+	config  S3Config
 }
 
-func newS3StorageProvider(region string) (StorageProvider, error) {
-	// The session the S3 Downloader will use
-	session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	))
-	return &S3StorageProvider{session: session}, nil
+func newS3StorageProvider(config S3Config) (StorageProvider, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(config.Region),
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	if config.ForcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	session, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &S3StorageProvider{session: session, config: config}, nil
 }
 
-// The caller must close
+// The caller must close. The returned reader streams the object body, nothing is buffered beyond what the
+// underlying http response holds.
 func (s S3StorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
-	// Create a downloader with the session and default options
-	downloader := s3manager.NewDownloader(s.session)
-	w := aws.NewWriteAtBuffer(make([]byte, DEFAULT_FILE_BUF_SIZE_BYTES))
-	size, err := downloader.Download(w, &s3.GetObjectInput{
+	svc := s3.New(s.session)
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &bucket,
-		Key: &object,
+		Key:    &object,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file, %v", err)
+		return nil, fmt.Errorf("failed to read object %s/%s, %w", bucket, object, err)
 	}
-	return ioutil.NopCloser(bytes.NewReader(w.Bytes()[:size])), nil
+	return resp.Body, nil
+}
+
+func (s S3StorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	svc := s3.New(s.session)
+	resp, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &object,
+	})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, err)
+	}
+	etag := strings.Trim(aws.StringValue(resp.ETag), "\"")
+	md5 := ""
+	// The ETag of an object uploaded in a single part is the MD5 of the content, while the multipart ones have a
+	// -<number of parts> suffix. It is not the MD5 when encrypted with KMS keys.
+	sse := aws.StringValue(resp.ServerSideEncryption)
+	if len(etag) == 32 && !strings.Contains(etag, "-") && (sse == "" || sse == s3.ServerSideEncryptionAes256) {
+		md5 = etag
+	}
+	return &ObjectAttrs{
+		ContentType:        aws.StringValue(resp.ContentType),
+		ContentEncoding:    aws.StringValue(resp.ContentEncoding),
+		CacheControl:       aws.StringValue(resp.CacheControl),
+		ContentDisposition: aws.StringValue(resp.ContentDisposition),
+		ContentLanguage:    aws.StringValue(resp.ContentLanguage),
+		Metadata:           aws.StringValueMap(resp.Metadata),
+		Size:               aws.Int64Value(resp.ContentLength),
+		ModTime:            aws.TimeValue(resp.LastModified),
+		MD5:                md5,
+		ETag:               etag,
+	}, nil
+}
+
+// Returns nil for the empty string, so that the field is not sent.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
 
 func (s S3StorageProvider) Close() error {
 	return nil
 }
 
+// S3ObjectWriter feeds the written bytes through a pipe to a multipart upload running in the background. At most
+// PartSize * Concurrency bytes are buffered at any point in time.
 type S3ObjectWriter struct {
-	b bytes.Buffer
-	s *S3StorageProvider
-	bucket, object string
+	w    *io.PipeWriter
+	done chan error
 }
 
 func (o *S3ObjectWriter) Close() error {
-	uploader := s3manager.NewUploader(o.s.session)
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: &o.bucket,
-		Key: &o.object,
-		Body: bufio.NewReader(&o.b),
-	})
-	if err != nil {
-		return err
+	o.w.Close()
+	return <-o.done
+}
+
+func (o *S3ObjectWriter) Write(p []byte) (n int, err error) {
+	return o.w.Write(p)
+}
+
+// Fails the upload, the uploader then aborts the multipart upload so no object or parts are left behind.
+func (o *S3ObjectWriter) Abort(err error) error {
+	if err == nil {
+		err = ErrAborted
 	}
+	o.w.CloseWithError(err)
+	<-o.done
 	return nil
 }
 
-func (o *S3ObjectWriter) Write(p []byte) (n int, err error) {
-	return o.b.Write(p)
+func (s S3StorageProvider) newUploader() *s3manager.Uploader {
+	return s3manager.NewUploader(s.session, func(u *s3manager.Uploader) {
+		if s.config.PartSize > 0 {
+			u.PartSize = s.config.PartSize
+		}
+		if s.config.Concurrency > 0 {
+			u.Concurrency = s.config.Concurrency
+		}
+	})
 }
 
-func (s S3StorageProvider) ObjectWriter(ctx context.Context, bucket string, object string) (io.WriteCloser, error) {
-	var o S3ObjectWriter
-	o.s = &s
-	o.bucket = bucket
-	o.object = object
-	return &o, nil
+func (s S3StorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	r, w := io.Pipe()
+	o := &S3ObjectWriter{w: w, done: make(chan error, 1)}
+	uploader := s.newUploader()
+	input := &s3manager.UploadInput{
+		Bucket: &bucket,
+		Key:    &object,
+		Body:   r,
+	}
+	if attrs != nil {
+		input.ContentType = optionalString(attrs.ContentType)
+		input.ContentEncoding = optionalString(attrs.ContentEncoding)
+		input.CacheControl = optionalString(attrs.CacheControl)
+		input.ContentDisposition = optionalString(attrs.ContentDisposition)
+		input.ContentLanguage = optionalString(attrs.ContentLanguage)
+		if len(attrs.Metadata) > 0 {
+			input.Metadata = aws.StringMap(attrs.Metadata)
+		}
+	}
+	go func() {
+		_, err := uploader.UploadWithContext(ctx, input)
+		// Unblock any pending writes if the upload stopped early.
+		r.CloseWithError(err)
+		o.done <- err
+	}()
+	return o, nil
+}
+
+// Puts the object with "If-None-Match: *", which fails with 412 if the object exists. A concurrent conditional write
+// of the same object fails with 409, the other write wins then. The header is set on the request directly since this
+// SDK version does not model it.
+func (s S3StorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	svc := s3.New(s.session)
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &object,
+		Body:   bytes.NewReader(content),
+	})
+	req.SetContext(ctx)
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	err := req.Send()
+	if status, ok := getStatusCode(err); ok && (status == http.StatusPreconditionFailed || status == http.StatusConflict) {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, ErrObjectExists)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, err)
+	}
+	return nil
 }
 
 func (s S3StorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
@@ -90,21 +195,45 @@ func (s S3StorageProvider) DeleteObject(ctx context.Context, bucket string, obje
 	return nil
 }
 
-func (s S3StorageProvider) ListObjects(ctx context.Context, bucket string) ([]string, error) {
-	svc := s3.New(s.session)
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &bucket})
-	if err != nil {
-		fmt.Printf("he | %s | %s\n", bucket, err)
-		return nil, err
+// Fetches one page of the listing at a time.
+type s3ObjectIterator struct {
+	ctx   context.Context
+	svc   *s3.S3
+	input *s3.ListObjectsV2Input
+	page  []*s3.Object
+	// Set once the last page has been fetched.
+	lastPage bool
+}
+
+func (i *s3ObjectIterator) Next() (*ObjectInfo, error) {
+	for len(i.page) == 0 {
+		if i.lastPage {
+			return nil, Done
+		}
+		resp, err := i.svc.ListObjectsV2WithContext(i.ctx, i.input)
+		if err != nil {
+			return nil, fmt.Errorf("error listing bucket %s. %w", *i.input.Bucket, err)
+		}
+		i.page = resp.Contents
+		if resp.IsTruncated != nil && *resp.IsTruncated {
+			i.input.ContinuationToken = resp.NextContinuationToken
+		} else {
+			i.lastPage = true
+		}
 	}
+	o := i.page[0]
+	i.page = i.page[1:]
+	return &ObjectInfo{Name: aws.StringValue(o.Key), Size: aws.Int64Value(o.Size), ModTime: aws.TimeValue(o.LastModified)}, nil
+}
 
-	var objects []string
-	for _, f := range resp.Contents {
-		objects = append(objects, *f.Key)
+func (s S3StorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
 	}
-	return objects, nil
+	return &s3ObjectIterator{ctx: ctx, svc: s3.New(s.session), input: input}
 }
 
 func (s S3StorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
 	return strings.TrimPrefix(bucketFullName, "s3://"), nil
-}
\ No newline at end of file
+}
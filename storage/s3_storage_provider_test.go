@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal in-process stand-in for the S3 REST api, using path style addressing.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	// The content and user metadata headers of the objects and pending multipart uploads.
+	headers       map[string]http.Header
+	uploadHeaders map[string]http.Header
+	uploads       map[string]map[int][]byte
+	nextId        int
+	// Number of completed multipart uploads.
+	multipartCompleted int
+	// The max number of keys returned in one list page.
+	pageSize int
+	// Number of list requests served.
+	listCalls int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}, uploadHeaders: map[string]http.Header{},
+		uploads: map[string]map[int][]byte{}, pageSize: 1000}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	parts := strings.SplitN(path, "/", 2)
+	bucket := parts[0]
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet {
+			f.list(w, bucket, query)
+			return
+		}
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	key := path
+
+	switch {
+	case r.Method == http.MethodPost && hasQueryKey(r, "uploads"):
+		f.nextId++
+		id := strconv.Itoa(f.nextId)
+		f.uploads[id] = map[int][]byte{}
+		f.uploadHeaders[id] = objectHeaders(r)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, parts[1], id)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		b, _ := ioutil.ReadAll(r.Body)
+		upload[n] = b
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", n))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range upload {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var b bytes.Buffer
+		for _, n := range numbers {
+			b.Write(upload[n])
+		}
+		f.objects[key] = b.Bytes()
+		f.headers[key] = f.uploadHeaders[query.Get("uploadId")]
+		f.headers[key].Set("ETag", fmt.Sprintf("\"%x-%d\"", md5.Sum(f.objects[key]), len(numbers)))
+		delete(f.uploads, query.Get("uploadId"))
+		f.multipartCompleted++
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"multipart\"</ETag></CompleteMultipartUploadResult>", bucket, parts[1])
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = b
+		f.headers[key] = objectHeaders(r)
+		f.headers[key].Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(b)))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range f.headers[key] {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Returns the content and user metadata headers of the request.
+func objectHeaders(r *http.Request) http.Header {
+	h := http.Header{}
+	for k, v := range r.Header {
+		switch {
+		case k == "Content-Type", k == "Content-Encoding", k == "Cache-Control", k == "Content-Disposition",
+			k == "Content-Language", strings.HasPrefix(k, "X-Amz-Meta-"):
+			h[k] = v
+		}
+	}
+	return h
+}
+
+func hasQueryKey(r *http.Request, key string) bool {
+	_, ok := r.URL.Query()[key]
+	return ok
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+type fakeS3Contents struct {
+	Key  string
+	Size int
+}
+
+type fakeS3CommonPrefix struct {
+	Prefix string
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Contents
+	CommonPrefixes        []fakeS3CommonPrefix
+}
+
+// Lists the keys in order. The continuation token is simply the last key returned.
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	f.listCalls++
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("continuation-token")
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(k, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	result := fakeS3ListResult{Name: bucket, Prefix: prefix, MaxKeys: f.pageSize}
+	seenPrefixes := map[string]bool{}
+	for _, k := range keys {
+		if k <= after {
+			continue
+		}
+		if result.KeyCount == f.pageSize {
+			result.IsTruncated = true
+			break
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seenPrefixes[p] {
+				seenPrefixes[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, fakeS3CommonPrefix{p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Contents{Key: k, Size: len(f.objects[bucket+"/"+k])})
+		result.KeyCount++
+		result.NextContinuationToken = k
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	b, _ := xml.Marshal(result)
+	w.Write(b)
+}
+
+func newTestS3StorageProvider(t *testing.T, f *fakeS3, partSize int64) (StorageProvider, func()) {
+	server := httptest.NewServer(f)
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	s, err := newS3StorageProvider(S3Config{
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+		PartSize:       partSize,
+		Concurrency:    2,
+	})
+	assert.NoError(t, err)
+	return s, server.Close
+}
+
+func TestS3ReadStreamsObject(t *testing.T) {
+	f := newFakeS3()
+	f.objects["src/hello"] = []byte("hello world")
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	r, err := s.ObjectReader(context.Background(), "src", "hello")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "hello world", string(b))
+}
+
+func TestS3ReadMissingObject(t *testing.T) {
+	s, closer := newTestS3StorageProvider(t, newFakeS3(), 0)
+	defer closer()
+
+	_, err := s.ObjectReader(context.Background(), "src", "missing")
+	assert.Error(t, err)
+}
+
+func TestS3WriteSmallObject(t *testing.T) {
+	f := newFakeS3()
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	w, err := s.ObjectWriter(context.Background(), "dst", "small", nil)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("Hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "Hello", string(f.objects["dst/small"]))
+	assert.Equal(t, 0, f.multipartCompleted)
+}
+
+func TestS3CreateObject(t *testing.T) {
+	f := newFakeS3()
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	assert.NoError(t, CreateObject(context.Background(), s, "s3://dst", "lease", []byte("a")))
+	err := CreateObject(context.Background(), s, "s3://dst", "lease", []byte("b"))
+	assert.True(t, errors.Is(err, ErrObjectExists))
+	assert.Equal(t, "a", string(f.objects["dst/lease"]))
+}
+
+func TestS3WriteMultipartObject(t *testing.T) {
+	f := newFakeS3()
+	partSize := int64(5 * 1024 * 1024)
+	s, closer := newTestS3StorageProvider(t, f, partSize)
+	defer closer()
+
+	w, err := s.ObjectWriter(context.Background(), "dst", "large", nil)
+	assert.NoError(t, err)
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var expected bytes.Buffer
+	for int64(expected.Len()) < 2*partSize+1024 {
+		_, err = w.Write(chunk)
+		assert.NoError(t, err)
+		expected.Write(chunk)
+	}
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 1, f.multipartCompleted)
+	assert.Equal(t, expected.Len(), len(f.objects["dst/large"]))
+	assert.True(t, bytes.Equal(expected.Bytes(), f.objects["dst/large"]))
+}
+
+func TestS3ListObjectsPaginates(t *testing.T) {
+	f := newFakeS3()
+	f.pageSize = 2
+	for i := 0; i < 5; i++ {
+		f.objects[fmt.Sprintf("src/%d", i)] = []byte("x")
+	}
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	objects, err := ListObjects(context.Background(), s, "s3://src", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, objects)
+	assert.Equal(t, 3, f.listCalls)
+}
+
+func TestS3ListObjectsPrefixAndDelimiter(t *testing.T) {
+	f := newFakeS3()
+	for _, k := range []string{"a/1", "a/2", "a/b/3", "c/4"} {
+		f.objects["src/"+k] = []byte("x")
+	}
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	objects, err := ListObjects(context.Background(), s, "s3://src", "a/", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2"}, objects)
+
+	objects, err = ListObjects(context.Background(), s, "s3://src", "a/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2", "a/b/3"}, objects)
+}
+
+func TestS3IteratorFetchesPagesLazily(t *testing.T) {
+	f := newFakeS3()
+	f.pageSize = 2
+	for i := 0; i < 5; i++ {
+		f.objects[fmt.Sprintf("src/%d", i)] = []byte("xx")
+	}
+	s, closer := newTestS3StorageProvider(t, f, 0)
+	defer closer()
+
+	it := s.IterateObjects(context.Background(), "src", "", "")
+	o, err := it.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", o.Name)
+	assert.Equal(t, int64(2), o.Size)
+	assert.Equal(t, 1, f.listCalls)
+	for i := 1; i < 5; i++ {
+		_, err = it.Next()
+		assert.NoError(t, err)
+	}
+	_, err = it.Next()
+	assert.Equal(t, Done, err)
+	assert.Equal(t, 3, f.listCalls)
+}
+
+func TestS3AbortMultipartObject(t *testing.T) {
+	f := newFakeS3()
+	partSize := int64(5 * 1024 * 1024)
+	s, closer := newTestS3StorageProvider(t, f, partSize)
+	defer closer()
+
+	w, err := s.ObjectWriter(context.Background(), "dst", "large", nil)
+	assert.NoError(t, err)
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	for written := int64(0); written < 2*partSize; written += int64(len(chunk)) {
+		_, err = w.Write(chunk)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Abort(errors.New("transform failed")))
+	assert.Empty(t, f.objects)
+	assert.Empty(t, f.uploads)
+	assert.Equal(t, 0, f.multipartCompleted)
+}
+
+func TestS3AbortSmallObject(t *testing.T) {
+	f := newFakeS3()
+	s, closer := newTestS3StorageProvider(t, f, 5*1024*1024)
+	defer closer()
+
+	w, err := s.ObjectWriter(context.Background(), "dst", "small", nil)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort(nil))
+	assert.Empty(t, f.objects)
+}
+
+func TestS3ObjectAttrs(t *testing.T) {
+	f := newFakeS3()
+	s, closer := newTestS3StorageProvider(t, f, 5*1024*1024)
+	defer closer()
+	attrs := &ObjectAttrs{ContentType: "text/plain", ContentEncoding: "gzip", CacheControl: "no-cache",
+		ContentDisposition: "attachment", ContentLanguage: "en", Metadata: map[string]string{"Owner": "kromium"}}
+
+	w, err := s.ObjectWriter(context.Background(), "dst", "a", attrs)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	stat, err := s.StatObject(context.Background(), "dst", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stat.Size)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", stat.MD5)
+	assert.Equal(t, stat.MD5, stat.ETag)
+	stat.Size = 0
+	stat.MD5 = ""
+	stat.ETag = ""
+	assert.Equal(t, attrs, stat)
+
+	_, err = s.StatObject(context.Background(), "dst", "missing")
+	assert.True(t, errors.Is(err, ErrObjectNotExist))
+}
+
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SftpStorageProvider serves the folder of an sftp://user@host:port/path uri. Each provider holds one ssh connection
+// to the host of the uri it was created for.
+type SftpStorageProvider struct {
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+func getSftpClientConfig(u *url.URL, config SftpConfig) (*ssh.ClientConfig, error) {
+	var key []byte
+	var err error
+	if config.PrivateKey != "" {
+		key = []byte(config.PrivateKey)
+	} else {
+		keyPath := config.PrivateKeyPath
+		if keyPath == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			keyPath = filepath.Join(home, ".ssh", "id_rsa")
+		}
+		if key, err = ioutil.ReadFile(keyPath); err != nil {
+			return nil, fmt.Errorf("failed to read the ssh private key, %v", err)
+		}
+	}
+
+	var signer ssh.Signer
+	if config.PrivateKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(config.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the ssh private key, %v", err)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if config.InsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHostsPath := config.KnownHostsPath
+		if knownHostsPath == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		if hostKeyCallback, err = knownhosts.New(knownHostsPath); err != nil {
+			return nil, fmt.Errorf("failed to read the known hosts, %v", err)
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func newSftpStorageProvider(uri string, config SftpConfig) (StorageProvider, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp uri %s, %v", uri, err)
+	}
+	clientConfig, err := getSftpClientConfig(u, config)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":22"
+	}
+	sshClient, err := ssh.Dial("tcp", host, clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s, %v", host, err)
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &SftpStorageProvider{sshClient: sshClient, client: client}, nil
+}
+
+// The bucket is the folder path on the server.
+func (s SftpStorageProvider) objectPath(bucket string, object string) string {
+	return path.Join(bucket, object)
+}
+
+func (s SftpStorageProvider) ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	return s.client.Open(s.objectPath(bucket, object))
+}
+
+// SftpObjectWriter writes to a temp file next to the object, which replaces the object only when the writer is closed.
+type SftpObjectWriter struct {
+	client *sftp.Client
+	f      *sftp.File
+	name   string
+	attrs  *ObjectAttrs
+}
+
+func (w *SftpObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *SftpObjectWriter) Close() error {
+	err := w.f.Close()
+	if err == nil && w.attrs != nil && w.attrs.Mode != 0 {
+		err = w.client.Chmod(w.f.Name(), w.attrs.Mode.Perm())
+	}
+	if err == nil && w.attrs != nil && !w.attrs.ModTime.IsZero() {
+		err = w.client.Chtimes(w.f.Name(), w.attrs.ModTime, w.attrs.ModTime)
+	}
+	if err == nil {
+		// The plain sftp rename fails if the object exists, the posix-rename extension replaces it.
+		err = w.client.PosixRename(w.f.Name(), w.name)
+	}
+	if err != nil {
+		w.client.Remove(w.f.Name())
+	}
+	return err
+}
+
+// Removes the temp file, the object is left untouched.
+func (w *SftpObjectWriter) Abort(err error) error {
+	w.f.Close()
+	return w.client.Remove(w.f.Name())
+}
+
+// Only the modification time and the permission bits are kept by the file system.
+func (s SftpStorageProvider) StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error) {
+	info, err := s.client.Stat(s.objectPath(bucket, object))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat object %s/%s, %w", bucket, object, ErrObjectNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode().Perm()}, nil
+}
+
+func (s SftpStorageProvider) ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
+	name := s.objectPath(bucket, object)
+	if err := s.client.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	f, err := s.client.Create(path.Join(path.Dir(name), cLocalTempPrefix+uuid.New().String()))
+	if err != nil {
+		return nil, err
+	}
+	return &SftpObjectWriter{client: s.client, f: f, name: name, attrs: attrs}, nil
+}
+
+// Opens the file with O_EXCL, so only one of the concurrent creators succeeds.
+func (s SftpStorageProvider) CreateObject(ctx context.Context, bucket string, object string, content []byte) error {
+	name := s.objectPath(bucket, object)
+	if err := s.client.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := s.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// The servers report the existing file with different status codes.
+		if _, serr := s.client.Stat(name); serr == nil {
+			return fmt.Errorf("failed to create object %s/%s, %w", bucket, object, ErrObjectExists)
+		}
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.client.Remove(name)
+	}
+	return err
+}
+
+func (s SftpStorageProvider) DeleteObject(ctx context.Context, bucket string, object string) error {
+	return s.client.Remove(s.objectPath(bucket, object))
+}
+
+// Removes the temp files left behind by writers which were never closed, like LocalStorageProvider does.
+func (s SftpStorageProvider) CleanTempFiles(ctx context.Context, bucket string, olderThan time.Duration) (int, error) {
+	if _, err := s.client.Stat(bucket); os.IsNotExist(err) {
+		return 0, nil
+	}
+	removed := 0
+	walker := s.client.Walk(bucket)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return removed, err
+		}
+		info := walker.Stat()
+		if info.IsDir() || !strings.HasPrefix(info.Name(), cLocalTempPrefix) || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		if err := s.client.Remove(walker.Path()); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (s SftpStorageProvider) IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator {
+	if _, err := s.client.Stat(bucket); err != nil {
+		return &dirTreeIterator{err: err}
+	}
+	return newDirTreeIterator(func(dir string) ([]os.FileInfo, error) {
+		files, err := s.client.ReadDir(path.Join(bucket, dir))
+		if err != nil {
+			return nil, err
+		}
+		return withoutTempFiles(files), nil
+	}, prefix, delimiter)
+}
+
+func (s SftpStorageProvider) GetBucketName(ctx context.Context, bucketFullName string) (string, error) {
+	u, err := url.Parse(bucketFullName)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		return ".", nil
+	}
+	return u.Path, nil
+}
+
+func (s SftpStorageProvider) Close() error {
+	s.client.Close()
+	return s.sshClient.Close()
+}
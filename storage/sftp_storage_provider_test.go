@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// An in-process ssh server which serves the sftp subsystem on the local file system, accepting only the given key.
+type testSftpServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+}
+
+func newTestSftpServer(t *testing.T, clientKey ssh.PublicKey) *testSftpServer {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "kromium" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &testSftpServer{listener: listener, config: config, hostKey: hostSigner}
+	go s.serve()
+	return s
+}
+
+func (s *testSftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSftpServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+		go func() {
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+func (s *testSftpServer) Close() {
+	s.listener.Close()
+}
+
+// Starts a server and returns the provider connected to it, the root is the folder served.
+func newTestSftpStorageProvider(t *testing.T) (StorageProvider, string, func()) {
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	assert.NoError(t, err)
+	server := newTestSftpServer(t, clientSigner.PublicKey())
+
+	root, err := ioutil.TempDir("", "sftp_test")
+	assert.NoError(t, err)
+	knownHosts := filepath.Join(root, "known_hosts")
+	line := knownhosts.Line([]string{server.listener.Addr().String()}, server.hostKey.PublicKey())
+	assert.NoError(t, ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	bucket := filepath.Join(root, "bucket")
+	assert.NoError(t, os.Mkdir(bucket, 0700))
+	uri := fmt.Sprintf("sftp://kromium@%s%s", server.listener.Addr().String(), bucket)
+	p, err := GetStorageProvider(context.Background(), uri, &StorageConfig{SftpConfig: SftpConfig{
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(clientKey)})),
+		KnownHostsPath: knownHosts,
+	}})
+	assert.NoError(t, err)
+	return p, uri, func() {
+		p.Close()
+		server.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestSftpReadWriteDelete(t *testing.T) {
+	p, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+	ctx := context.Background()
+
+	w, err := GetObjectWriter(ctx, p, uri, "dir/a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	r, err := GetObjectReader(ctx, p, uri, "dir/a")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "hello", string(b))
+
+	assert.NoError(t, DeleteObject(ctx, p, uri, "dir/a"))
+	_, err = GetObjectReader(ctx, p, uri, "dir/a")
+	assert.Error(t, err)
+}
+
+func TestSftpCreateObject(t *testing.T) {
+	p, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+	ctx := context.Background()
+
+	assert.NoError(t, CreateObject(ctx, p, uri, "dir/lease", []byte("a")))
+	err := CreateObject(ctx, p, uri, "dir/lease", []byte("b"))
+	assert.True(t, errors.Is(err, ErrObjectExists))
+	r, err := GetObjectReader(ctx, p, uri, "dir/lease")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "a", string(b))
+}
+
+func TestSftpListObjects(t *testing.T) {
+	p, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+	ctx := context.Background()
+	for _, o := range []string{"b", "a", "sub/c", "sub/nested/d"} {
+		w, err := GetObjectWriter(ctx, p, uri, o)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+
+	objects, err := ListObjects(ctx, p, uri, "", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, objects)
+	objects, err = ListObjects(ctx, p, uri, "sub/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sub/c", "sub/nested/d"}, objects)
+}
+
+func TestSftpUnknownHostKeyIsRejected(t *testing.T) {
+	_, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	knownHosts, err := ioutil.TempFile("", "known_hosts")
+	assert.NoError(t, err)
+	knownHosts.Close()
+	defer os.Remove(knownHosts.Name())
+
+	_, err = GetStorageProvider(context.Background(), uri, &StorageConfig{SftpConfig: SftpConfig{
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(clientKey)})),
+		KnownHostsPath: knownHosts.Name(),
+	}})
+	assert.Error(t, err)
+}
+
+func TestSftpWriteReplacesObjectAndAbortKeepsIt(t *testing.T) {
+	p, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+	ctx := context.Background()
+	for _, content := range []string{"a much longer content", "short"} {
+		w, err := GetObjectWriter(ctx, p, uri, "a")
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+
+	w, err := GetObjectWriter(ctx, p, uri, "a")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort(nil))
+
+	r, err := GetObjectReader(ctx, p, uri, "a")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "short", string(b))
+	objects, err := ListObjects(ctx, p, uri, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, objects)
+}
+
+func TestSftpCleanTempFiles(t *testing.T) {
+	p, uri, closer := newTestSftpStorageProvider(t)
+	defer closer()
+	ctx := context.Background()
+	stale, err := GetObjectWriter(ctx, p, uri, "sub/stale")
+	assert.NoError(t, err)
+	staleFile := stale.(*SftpObjectWriter).f
+	staleFile.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, stale.(*SftpObjectWriter).client.Chtimes(staleFile.Name(), old, old))
+	fresh, err := GetObjectWriter(ctx, p, uri, "fresh")
+	assert.NoError(t, err)
+
+	n, err := CleanTempFiles(ctx, p, uri, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = os.Stat(staleFile.Name())
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, fresh.Close())
+	objects, err := ListObjects(ctx, p, uri, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fresh"}, objects)
+}
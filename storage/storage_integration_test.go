@@ -11,7 +11,7 @@ import (
 )
 
 func TestS3Read(t *testing.T) {
-	s, err := newS3StorageProvider("us-east-1")
+	s, err := newS3StorageProvider(S3Config{Region: "us-east-1"})
 	assert.NoError(t, err)
 	r, err := s.ObjectReader(context.Background(), "kromium-src", "hello")
 	assert.NoError(t, err)
@@ -22,9 +22,9 @@ func TestS3Read(t *testing.T) {
 }
 
 func TestS3Write(t *testing.T) {
-	s, err := newS3StorageProvider("us-east-1")
+	s, err := newS3StorageProvider(S3Config{Region: "us-east-1"})
 	assert.NoError(t, err)
-	w, err := s.ObjectWriter(context.Background(), "kromium-src", "tmp1")
+	w, err := s.ObjectWriter(context.Background(), "kromium-src", "tmp1", nil)
 	assert.NoError(t, err)
 	written, err := w.Write([]byte("Hello"))
 	assert.NoError(t, err)
@@ -2,36 +2,234 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
+	"time"
 )
 
 type S3Config struct {
 	Region string
+	// Optional endpoint for S3 compatible stores, e.g. http://localhost:9000 for minio.
+	Endpoint string
+	// Use path style addressing (endpoint/bucket/key), usually needed along with Endpoint.
+	ForcePathStyle bool
+	// The multipart upload part size in bytes. Defaults to 5MB which is also the minimum allowed by S3.
+	PartSize int64
+	// The number of parts of a single object uploaded in parallel. Defaults to 5.
+	Concurrency int
+}
+
+type AzureConfig struct {
+	// The storage account name.
+	AccountName string
+	// The shared key of the storage account. If not set, the AZURE_STORAGE_KEY env var is used. If neither is set the
+	// requests are anonymous, e.g. for a SAS token in the Endpoint.
+	AccountKey string
+	// Optional blob service endpoint, defaults to https://<AccountName>.blob.core.windows.net. For the Azurite
+	// emulator use http://127.0.0.1:10000/devstoreaccount1.
+	Endpoint string
+	// The block size in bytes for uploads. Defaults to 1MB.
+	BlockSize int
+	// The number of blocks of a single object uploaded in parallel. Defaults to 1.
+	Concurrency int
+}
+
+// The user and host are part of the sftp://user@host:port/path uri, only key based auth is supported.
+type SftpConfig struct {
+	// The path of the private key, defaults to ~/.ssh/id_rsa.
+	PrivateKeyPath string
+	// The PEM encoded private key, used instead of PrivateKeyPath if set.
+	PrivateKey string
+	// The passphrase if the private key is encrypted.
+	PrivateKeyPassphrase string
+	// The known hosts file used for verifying the host key, defaults to ~/.ssh/known_hosts.
+	KnownHostsPath string
+	// Skip the host key verification. Only meant for testing.
+	InsecureIgnoreHostKey bool
+}
+
+// The http:// and https:// uris are read-only, and can only be used as the source.
+type HttpConfig struct {
+	// Optional url or local path of a manifest file listing the object urls, one per line. The urls can be absolute or
+	// relative to the source url, but must be under it. If not set, the objects are listed by crawling the links of the
+	// index page at the source url, e.g. the folder listing of a static file server.
+	Manifest string
+	// Headers sent with every request, e.g. {"Authorization": "Bearer ${TOKEN}"}. Env vars in the values are expanded.
+	Headers map[string]string
 }
 
 type StorageConfig struct {
-	S3Config S3Config
+	S3Config    S3Config
+	AzureConfig AzureConfig
+	SftpConfig  SftpConfig
+	HttpConfig  HttpConfig
+}
+
+// The attributes of an object besides its content, the empty fields are unset.
+type ObjectAttrs struct {
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	// The user defined metadata.
+	Metadata map[string]string
+	// Returned by StatObject, ignored on write.
+	Size int64
+	// The modification time, only the file system providers set it on write.
+	ModTime time.Time
+	// The permission bits, only used by the file system providers.
+	Mode os.FileMode
+	// The hex encoded MD5 of the content if the provider knows it, returned by StatObject and ignored on write.
+	MD5 string
+	// The hex encoded (big-endian) CRC32C of the content if the provider knows it, returned by StatObject and ignored
+	// on write.
+	CRC32C string
+	// The version of the content, only comparable between objects of the same provider. Returned by StatObject and
+	// ignored on write.
+	ETag string
+}
+
+// Returns a deep copy, so that the metadata map can be modified.
+func (a *ObjectAttrs) Copy() *ObjectAttrs {
+	c := *a
+	if a.Metadata != nil {
+		c.Metadata = make(map[string]string, len(a.Metadata))
+		for k, v := range a.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
+
+// The listing entry of an object.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Returned by StatObject (possibly wrapped, check with errors.Is) when the object does not exist.
+var ErrObjectNotExist = errors.New("object does not exist")
+
+// Returned by CreateObject (possibly wrapped, check with errors.Is) when the object already exists.
+var ErrObjectExists = errors.New("object already exists")
+
+// Returned by ObjectIterator.Next once all the objects have been returned.
+var Done = errors.New("no more objects in iterator")
+
+// Returned by writes after the writer was aborted, and used as the abort cause if none is given.
+var ErrAborted = errors.New("object write aborted")
+
+// The writer of an object. Close publishes the object, while Abort discards everything written so far so that the
+// object is left as it was before the write started.
+type ObjectWriteCloser interface {
+	io.WriteCloser
+	// Abort discards the object with the given cause. The writer must not be used after Abort or Close.
+	Abort(err error) error
+}
+
+// Iterates over the objects of a bucket, fetching the listing lazily (e.g. page by page) as Next is called.
+type ObjectIterator interface {
+	Next() (*ObjectInfo, error)
 }
 
 type StorageProvider interface {
 	// The caller will close.
 	ObjectReader(ctx context.Context, bucket string, object string) (io.ReadCloser, error)
-	// The caller will close. Exception is that close should also flush any pending data.
-	ObjectWriter(ctx context.Context, bucket string, object string) (io.WriteCloser, error)
+	// Returns the attributes of the object. The ones the provider does not support are left empty.
+	StatObject(ctx context.Context, bucket string, object string) (*ObjectAttrs, error)
+	// The caller will close, or abort if the object should not be published. Close should also flush any pending data.
+	// The attrs are optional, the ones the provider does not support are ignored.
+	ObjectWriter(ctx context.Context, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error)
 	DeleteObject(ctx context.Context, bucket string, object string) error
-	ListObjects(ctx context.Context, bucket string) ([]string, error)
+	// Iterates over the objects whose names start with prefix. If delimiter is non-empty, objects which have the
+	// delimiter in the name after the prefix are skipped, i.e. with "/" only the objects directly under the prefix
+	// folder are listed. An empty delimiter lists all the nested objects.
+	IterateObjects(ctx context.Context, bucket string, prefix string, delimiter string) ObjectIterator
 	GetBucketName(ctx context.Context, bucketFullName string) (string, error)
 	Close() error
 }
 
-func GetObjectWriter(ctx context.Context, s StorageProvider, bucket string, object string) (io.WriteCloser, error) {
+// Implemented by the providers which can leave temp files behind when a write is interrupted, e.g. by a crash.
+type TempFileCleaner interface {
+	// Removes the temp files in the bucket which have not been modified for olderThan, returns the number removed.
+	CleanTempFiles(ctx context.Context, bucket string, olderThan time.Duration) (int, error)
+}
+
+// Implemented by the providers which can create an object only if it does not exist, atomically, e.g. to claim a lease.
+type ObjectCreator interface {
+	// Writes the object with the content, or returns ErrObjectExists if it already exists. A reader can see the object
+	// before the content is fully written on the file system providers.
+	CreateObject(ctx context.Context, bucket string, object string, content []byte) error
+}
+
+// Returns true if the provider can create objects conditionally with CreateObject.
+func CanCreateObject(s StorageProvider) bool {
+	_, ok := s.(ObjectCreator)
+	return ok
+}
+
+// Returns true if the objects of the provider cannot be written or deleted, i.e. for http(s).
+func IsReadOnly(s StorageProvider) bool {
+	_, ok := s.(*HttpStorageProvider)
+	return ok
+}
+
+// Returns false if the provider lists the objects without their size, which is then 0 until the object is read, i.e.
+// for http(s).
+func ListsObjectSizes(s StorageProvider) bool {
+	_, ok := s.(*HttpStorageProvider)
+	return !ok
+}
+
+// Creates the object with the content only if it does not exist, returns ErrObjectExists otherwise.
+func CreateObject(ctx context.Context, s StorageProvider, bucket string, object string, content []byte) error {
+	c, ok := s.(ObjectCreator)
+	if !ok {
+		return fmt.Errorf("conditional create is not supported for %s", bucket)
+	}
+	b, err := s.GetBucketName(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	return c.CreateObject(ctx, b, object, content)
+}
+
+// Cleans up the temp files of the bucket if the provider can leave any behind.
+func CleanTempFiles(ctx context.Context, s StorageProvider, bucket string, olderThan time.Duration) (int, error) {
+	c, ok := s.(TempFileCleaner)
+	if !ok {
+		return 0, nil
+	}
+	b, err := s.GetBucketName(ctx, bucket)
+	if err != nil {
+		return 0, err
+	}
+	return c.CleanTempFiles(ctx, b, olderThan)
+}
+
+func GetObjectWriter(ctx context.Context, s StorageProvider, bucket string, object string) (ObjectWriteCloser, error) {
+	return GetObjectWriterWithAttrs(ctx, s, bucket, object, nil)
+}
+
+func GetObjectWriterWithAttrs(ctx context.Context, s StorageProvider, bucket string, object string, attrs *ObjectAttrs) (ObjectWriteCloser, error) {
 	b, err := s.GetBucketName(ctx, bucket)
 	if err != nil {
 		return nil, err
 	}
-	return s.ObjectWriter(ctx, b, object)
+	return s.ObjectWriter(ctx, b, object, attrs)
+}
+
+func StatObject(ctx context.Context, s StorageProvider, bucket string, object string) (*ObjectAttrs, error) {
+	b, err := s.GetBucketName(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return s.StatObject(ctx, b, object)
 }
 
 func GetObjectReader(ctx context.Context, s StorageProvider, bucket string, object string) (io.ReadCloser, error) {
@@ -50,12 +248,31 @@ func DeleteObject(ctx context.Context, s StorageProvider, bucket string, object
 	return s.DeleteObject(ctx, b, object)
 }
 
-func ListObjects(ctx context.Context, s StorageProvider, bucket string) ([]string, error) {
+func GetObjectIterator(ctx context.Context, s StorageProvider, bucket string, prefix string, delimiter string) (ObjectIterator, error) {
 	b, err := s.GetBucketName(ctx, bucket)
 	if err != nil {
 		return nil, err
 	}
-	return s.ListObjects(ctx, b)
+	return s.IterateObjects(ctx, b, prefix, delimiter), nil
+}
+
+// Returns the names of all the objects, use GetObjectIterator for buckets which could be large.
+func ListObjects(ctx context.Context, s StorageProvider, bucket string, prefix string, delimiter string) ([]string, error) {
+	it, err := GetObjectIterator(ctx, s, bucket, prefix, delimiter)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		o, err := it.Next()
+		if err == Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, o.Name)
+	}
 }
 
 func GetStorageProvider(ctx context.Context, uri string, storageConfig *StorageConfig) (StorageProvider, error) {
@@ -66,7 +283,19 @@ func GetStorageProvider(ctx context.Context, uri string, storageConfig *StorageC
 		return &LocalStorageProvider{}, nil
 	}
 	if strings.HasPrefix(uri, "s3://") {
-		return newS3StorageProvider(storageConfig.S3Config.Region)
+		return newS3StorageProvider(storageConfig.S3Config)
+	}
+	if strings.HasPrefix(uri, "mem://") {
+		return &MemoryStorageProvider{}, nil
+	}
+	if strings.HasPrefix(uri, "az://") {
+		return newAzureStorageProvider(storageConfig.AzureConfig)
+	}
+	if strings.HasPrefix(uri, "sftp://") {
+		return newSftpStorageProvider(uri, storageConfig.SftpConfig)
+	}
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return newHttpStorageProvider(storageConfig.HttpConfig)
 	}
 	return nil, fmt.Errorf("No storage provider found for %s", uri)
 }
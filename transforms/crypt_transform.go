@@ -5,7 +5,9 @@ import (
 	"crypto/cipher"
 	"encoding/hex"
 	"encoding/json"
+	"github.com/sharvanath/kromium/storage"
 	"io"
+	"strings"
 )
 
 type EncryptionTransform struct {
@@ -81,4 +83,18 @@ func (e DecryptionTransform) Transform(dst io.Writer, src io.Reader) (interface{
 		panic(err)
 	}
 	return nil, err
-}
\ No newline at end of file
+}
+
+func (e EncryptionTransform) TransformName(name string) string {
+	return name + ".enc"
+}
+
+func (e DecryptionTransform) TransformName(name string) string {
+	return strings.TrimSuffix(name, ".enc")
+}
+
+// The encrypted content is opaque.
+func (e EncryptionTransform) TransformAttrs(attrs *storage.ObjectAttrs) {
+	attrs.ContentType = "application/octet-stream"
+	attrs.ContentEncoding = ""
+}
@@ -2,7 +2,9 @@ package transforms
 
 import (
 	"compress/gzip"
+	"github.com/sharvanath/kromium/storage"
 	"io"
+	"strings"
 )
 
 type GzipCompressTransform struct {
@@ -36,4 +38,20 @@ func (i GzipDecompressTransform) Transform(dst io.Writer, src io.Reader) (interf
 	_, err = io.Copy(dst, decompressReader)
 	decompressReader.Close()
 	return nil, err
-}
\ No newline at end of file
+}
+
+func (i GzipCompressTransform) TransformName(name string) string {
+	return name + ".gz"
+}
+
+func (i GzipDecompressTransform) TransformName(name string) string {
+	return strings.TrimSuffix(name, ".gz")
+}
+
+func (i GzipCompressTransform) TransformAttrs(attrs *storage.ObjectAttrs) {
+	addContentEncoding(attrs, "gzip")
+}
+
+func (i GzipDecompressTransform) TransformAttrs(attrs *storage.ObjectAttrs) {
+	removeContentEncoding(attrs, "gzip")
+}
@@ -1,7 +1,9 @@
 package transforms
 
 import (
+	"github.com/sharvanath/kromium/storage"
 	"io"
+	"strings"
 )
 
 type Transform interface {
@@ -11,6 +13,36 @@ type Transform interface {
 	Transform(dst io.Writer, src io.Reader) (interface{}, error)
 }
 
+// Implemented by the transforms which change the type or encoding of the content, so that the attributes of the
+// destination object can be updated accordingly.
+type AttrsTransform interface {
+	TransformAttrs(attrs *storage.ObjectAttrs)
+}
+
+// Implemented by the transforms which change the format of the content, so that the destination key can carry the
+// extension of the new format.
+type NameTransform interface {
+	// Returns the name with the extension of the transformed content, e.g. "a.txt.gz" for "a.txt" when compressing.
+	TransformName(name string) string
+}
+
+// Appends the encoding to the content encoding, which lists the encodings in the order they were applied.
+func addContentEncoding(attrs *storage.ObjectAttrs, encoding string) {
+	if attrs.ContentEncoding == "" {
+		attrs.ContentEncoding = encoding
+	} else {
+		attrs.ContentEncoding += ", " + encoding
+	}
+}
+
+// Removes the encoding if it was the last one applied.
+func removeContentEncoding(attrs *storage.ObjectAttrs, encoding string) {
+	encodings := strings.Split(attrs.ContentEncoding, ",")
+	if strings.TrimSpace(encodings[len(encodings)-1]) == encoding {
+		attrs.ContentEncoding = strings.Join(encodings[:len(encodings)-1], ",")
+	}
+}
+
 func GetTransform(name string, args interface{}) Transform {
 	switch name {
 	case "Identity":